@@ -0,0 +1,451 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoHealthyUpstream is reported in Data.Error when every upstream of a
+// pool is ejected
+var ErrNoHealthyUpstream = errors.New("proxy: no healthy upstream")
+
+// upstream definition for the server we're proxying data to
+type upstream struct {
+	target url.URL
+	// socket is the path of the Unix domain socket the upstream listens on,
+	// the target host is a placeholder then
+	socket string
+
+	// transport dialing the socket, created on first use
+	once      sync.Once
+	transport http.RoundTripper
+
+	// inFlight counts the round trips to the upstream right now, see
+	// loadTransport
+	inFlight int64
+
+	// passive health state, see Config.EjectAfter
+	mu           sync.Mutex
+	failures     int
+	firstFailure time.Time
+	ejected      bool
+	ejectedUntil time.Time
+}
+
+// host placeholder of upstreams listening on a Unix domain socket
+const unixHost = "unix"
+
+// newUpstream creates upstream for the given URL. URLs like
+// unix:///var/run/app.sock point to Unix domain sockets
+func newUpstream(rawURL string) (*upstream, error) {
+	if strings.HasPrefix(rawURL, "unix://") {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: invalid target URL %q: %v", rawURL, err)
+		}
+		if u.Path == "" {
+			return nil, fmt.Errorf("proxy: target URL %q has no socket path", rawURL)
+		}
+		return &upstream{target: url.URL{Scheme: "http", Host: unixHost}, socket: u.Path}, nil
+	}
+
+	u, err := parseTarget(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &upstream{target: *u}, nil
+}
+
+// name of the upstream, as reported in Data.Upstream
+func (u *upstream) name() string {
+	if u.socket != "" {
+		return "unix:" + u.socket
+	}
+	return u.target.Host
+}
+
+// id of the upstream in sticky cookies, which doesn't reveal its address
+func (u *upstream) id() string {
+	sum := sha256.Sum256([]byte(u.name()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// roundTripper returns the transport to send requests to the upstream with.
+// Upstreams listening on a socket get one of their own, dialing it, unless a
+// custom Config.Transport is used
+func (u *upstream) roundTripper(shared http.RoundTripper, cfg *Config) http.RoundTripper {
+	if u.socket == "" || cfg.Transport != nil {
+		return shared
+	}
+
+	u.once.Do(func() {
+		t := newTransport(cfg)
+		dialer := &net.Dialer{Timeout: cfg.orDefault(cfg.DialTimeout)}
+		t.DialContext = withProxyHeader(cfg.ProxyProtocol, func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", u.socket)
+		})
+		u.transport = t
+	})
+	return u.transport
+}
+
+// available reports whether the upstream may take requests: it is either
+// healthy or its ejection cooldown has passed, and it's due to be probed
+func (u *upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return !now.Before(u.ejectedUntil)
+}
+
+// report the outcome of a request proxied to the upstream
+func (u *upstream) report(failed bool, cfg *Config) {
+	if cfg.EjectAfter <= 0 {
+		return
+	}
+
+	now := time.Now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !failed {
+		u.failures = 0
+		u.ejected = false
+		return
+	}
+
+	if u.failures == 0 || (cfg.EjectWindow > 0 && now.Sub(u.firstFailure) > cfg.EjectWindow) {
+		u.failures = 0
+		u.firstFailure = now
+	}
+	u.failures++
+
+	// an upstream failing the probe after its cooldown is ejected right away
+	if u.ejected || u.failures >= cfg.EjectAfter {
+		u.ejected = true
+		u.ejectedUntil = now.Add(cfg.EjectCooldown)
+		u.failures = 0
+	}
+}
+
+// balancer picks the upstream every request is proxied to
+type balancer interface {
+	pick(r *http.Request) (*upstream, error)
+}
+
+// pick makes a single upstream a balancer always choosing itself
+func (u *upstream) pick(*http.Request) (*upstream, error) {
+	return u, nil
+}
+
+// Strategy tells how requests are spread across the upstreams of a pool
+type Strategy int
+
+const (
+	// StrategyRoundRobin cycles through the upstreams in order
+	StrategyRoundRobin Strategy = iota + 1
+	// StrategyLeastConn picks the upstream with the fewest requests in
+	// flight, relative to its weight for WeightedTargets. It copes better
+	// than the others with requests of uneven durations
+	StrategyLeastConn
+	// StrategyWeighted gives upstreams shares of the requests in proportion
+	// to their weights, with the smooth weighted round-robin of nginx
+	StrategyWeighted
+)
+
+// WeightedTarget is an upstream URL with the share of requests it gets
+type WeightedTarget struct {
+	URL string
+	// Weight of the upstream relative to the others of its pool. Zero
+	// disables the upstream
+	Weight int
+}
+
+// pool is the set of upstreams a balancer spreads requests across
+type pool struct {
+	upstreams []*upstream
+	// weights of the upstreams, zero for disabled ones
+	weights []int
+	// cookie pinning clients to an upstream, see Config.StickyCookie
+	cookie string
+}
+
+func newPool(targets []WeightedTarget) (pool, error) {
+	var p pool
+	total := 0
+	for _, t := range targets {
+		if t.Weight < 0 {
+			return pool{}, fmt.Errorf("proxy: weight of %q must not be negative, got %d", t.URL, t.Weight)
+		}
+		u, err := newUpstream(t.URL)
+		if err != nil {
+			return pool{}, err
+		}
+		p.upstreams = append(p.upstreams, u)
+		p.weights = append(p.weights, t.Weight)
+		total += t.Weight
+	}
+	if total == 0 {
+		return pool{}, errors.New("proxy: at least one target must have a positive weight")
+	}
+
+	return p, nil
+}
+
+// members of the pool
+func (p *pool) members() []*upstream {
+	return p.upstreams
+}
+
+// members returns the upstreams b spreads requests across, none for
+// balancers picking them on the fly
+func members(b balancer) []*upstream {
+	switch b := b.(type) {
+	case *upstream:
+		return []*upstream{b}
+	case interface{ members() []*upstream }:
+		return b.members()
+	}
+	return nil
+}
+
+// eligible reports whether the i-th upstream may take requests
+func (p *pool) eligible(i int, now time.Time) bool {
+	return p.weights[i] > 0 && p.upstreams[i].available(now)
+}
+
+// pinned returns the eligible upstream the sticky cookie of r names, if any
+func (p *pool) pinned(r *http.Request, now time.Time) *upstream {
+	if p.cookie == "" || r == nil {
+		return nil
+	}
+	c, err := r.Cookie(p.cookie)
+	if err != nil {
+		return nil
+	}
+	for i, u := range p.upstreams {
+		if u.id() == c.Value && p.eligible(i, now) {
+			return u
+		}
+	}
+	return nil
+}
+
+// newPoolBalancer creates the balancer of the upstreams in cfg.Targets or
+// cfg.WeightedTargets, following cfg.Strategy
+func newPoolBalancer(cfg *Config) (balancer, error) {
+	targets := cfg.WeightedTargets
+	strategy := cfg.Strategy
+	if len(targets) == 0 {
+		for _, t := range cfg.Targets {
+			targets = append(targets, WeightedTarget{URL: t, Weight: 1})
+		}
+		if strategy == 0 {
+			strategy = StrategyRoundRobin
+		}
+	} else if len(cfg.Targets) > 0 {
+		return nil, errors.New("proxy: targets and weighted targets are mutually exclusive")
+	} else if strategy == 0 {
+		strategy = StrategyWeighted
+	}
+
+	p, err := newPool(targets)
+	if err != nil {
+		return nil, err
+	}
+	p.cookie = cfg.StickyCookie
+
+	switch strategy {
+	case StrategyLeastConn:
+		return &leastConn{pool: p}, nil
+	case StrategyWeighted:
+		return &weightedRoundRobin{pool: p, current: make([]int, len(p.upstreams))}, nil
+	default:
+		return &roundRobin{pool: p}, nil
+	}
+}
+
+// roundRobin cycles through upstreams in order, skipping ejected ones
+type roundRobin struct {
+	pool
+	counter uint64
+}
+
+func (b *roundRobin) pick(r *http.Request) (*upstream, error) {
+	now := time.Now()
+	if u := b.pinned(r, now); u != nil {
+		return u, nil
+	}
+	for range b.upstreams {
+		n := atomic.AddUint64(&b.counter, 1)
+		if i := int((n - 1) % uint64(len(b.upstreams))); b.eligible(i, now) {
+			return b.upstreams[i], nil
+		}
+	}
+
+	return nil, ErrNoHealthyUpstream
+}
+
+// weightedRoundRobin spreads requests across upstreams in proportion to
+// their weights, with the smooth weighted round-robin of nginx: each pick
+// raises the current weight of every upstream by its weight, and lowers the
+// highest one, which is picked, by their total. Heavy upstreams are thus
+// interleaved with the others rather than picked in bursts. Ejected
+// upstreams are skipped
+type weightedRoundRobin struct {
+	pool
+
+	mu      sync.Mutex
+	current []int
+}
+
+func (b *weightedRoundRobin) pick(r *http.Request) (*upstream, error) {
+	now := time.Now()
+	if u := b.pinned(r, now); u != nil {
+		return u, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	best, total := -1, 0
+	for i := range b.upstreams {
+		if !b.eligible(i, now) {
+			continue
+		}
+		b.current[i] += b.weights[i]
+		total += b.weights[i]
+		if best < 0 || b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil, ErrNoHealthyUpstream
+	}
+	b.current[best] -= total
+	return b.upstreams[best], nil
+}
+
+// leastConn picks the upstream with the fewest requests in flight relative
+// to its weight. Ties go to the upstreams in turn, so that an idle pool is
+// cycled through
+type leastConn struct {
+	pool
+	counter uint64
+}
+
+func (b *leastConn) pick(r *http.Request) (*upstream, error) {
+	now := time.Now()
+	if u := b.pinned(r, now); u != nil {
+		return u, nil
+	}
+
+	n := len(b.upstreams)
+	start := int(atomic.AddUint64(&b.counter, 1) % uint64(n))
+	best := -1
+	var bestLoad int64
+	for k := 0; k < n; k++ {
+		i := (start + k) % n
+		if !b.eligible(i, now) {
+			continue
+		}
+		// a/wa < b/wb without dividing
+		load := atomic.LoadInt64(&b.upstreams[i].inFlight)
+		if best < 0 || load*int64(b.weights[best]) < bestLoad*int64(b.weights[i]) {
+			best, bestLoad = i, load
+		}
+	}
+	if best < 0 {
+		return nil, ErrNoHealthyUpstream
+	}
+	return b.upstreams[best], nil
+}
+
+// loadTransport counts the round trips to up in flight, as the connections
+// of StrategyLeastConn. Responses replayed from the cache or a coalesced
+// request never get here. A round trip lasts until the body is closed
+type loadTransport struct {
+	next http.RoundTripper
+	up   *upstream
+}
+
+func (t *loadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.up.inFlight, 1)
+	res, err := t.next.RoundTrip(req)
+	// an upgraded connection is no request anymore, and its body must stay
+	// writable
+	if err != nil || res.Body == nil || res.StatusCode == http.StatusSwitchingProtocols {
+		atomic.AddInt64(&t.up.inFlight, -1)
+		return res, err
+	}
+	res.Body = &loadBody{ReadCloser: res.Body, up: t.up}
+	return res, nil
+}
+
+// loadBody ends a round trip counted by loadTransport once it's closed
+type loadBody struct {
+	io.ReadCloser
+	up   *upstream
+	once sync.Once
+}
+
+func (b *loadBody) Close() error {
+	b.once.Do(func() { atomic.AddInt64(&b.up.inFlight, -1) })
+	return b.ReadCloser.Close()
+}
+
+// setStickyCookie pins the client of r to up, unless it already is
+func setStickyCookie(w http.ResponseWriter, r *http.Request, up *upstream, name string) {
+	id := up.id()
+	if c, err := r.Cookie(name); err == nil && c.Value == id {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: name, Value: id, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+}
+
+// NewBalancedHandler creates http.HandlerFunc that spreads requests across the
+// given upstream URLs in round-robin order. Apart from that, it behaves like
+// the handler created by NewHandler
+func NewBalancedHandler(targets []string, timeout time.Duration, ch chan<- Data, cb func(status int, err error)) (http.HandlerFunc, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("proxy: at least one target URL is required")
+	}
+
+	return NewHandlerWithConfig(Config{
+		Targets:         targets,
+		Timeout:         timeout,
+		DataChan:        ch,
+		Callback:        cb,
+		CaptureRequest:  true,
+		CaptureResponse: true,
+	})
+}
+
+// NewWeightedHandler creates http.HandlerFunc that spreads requests across
+// the given upstreams in proportion to their weights. Apart from that, it
+// behaves like the handler created by NewHandler
+func NewWeightedHandler(targets []WeightedTarget, timeout time.Duration, ch chan<- Data, cb func(status int, err error)) (http.HandlerFunc, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("proxy: at least one target URL is required")
+	}
+
+	return NewHandlerWithConfig(Config{
+		WeightedTargets: targets,
+		Timeout:         timeout,
+		DataChan:        ch,
+		Callback:        cb,
+		CaptureRequest:  true,
+		CaptureResponse: true,
+	})
+}
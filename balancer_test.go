@@ -0,0 +1,476 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// upstream server responding with its name
+func newNamedServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, name, nil)
+	}))
+}
+
+func TestRoundRobinBalancing(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	first := newNamedServer("first")
+	defer first.Close()
+	second := newNamedServer("second")
+	defer second.Close()
+
+	h, err := proxy.NewBalancedHandler([]string{first.URL, second.URL}, timeout, mchan, nil)
+	require.NoError(t, err)
+
+	for _, name := range []string{"first", "second", "first", "second"} {
+		res := doRequest(t, h, http.MethodGet, nil)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		validateBody(t, res.Body, name)
+
+		expected := first
+		if name == "second" {
+			expected = second
+		}
+		data := <-mchan
+		require.Equal(t, expected.Listener.Addr().String(), data.Upstream)
+	}
+}
+
+func TestBalancedHandlerInvalidTargets(t *testing.T) {
+	_, err := proxy.NewBalancedHandler(nil, timeout, nil, nil)
+	require.Error(t, err)
+
+	_, err = proxy.NewBalancedHandler([]string{"http://localhost", "/relative"}, timeout, nil, nil)
+	require.Error(t, err)
+}
+
+func TestFailingUpstreamEjection(t *testing.T) {
+	cooldown := 200 * time.Millisecond
+
+	healthy := newNamedServer("healthy")
+	defer healthy.Close()
+
+	var failing int32 = 1
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeResponse(w, "flaky", nil)
+	}))
+	defer flaky.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		Targets:       []string{healthy.URL, flaky.URL},
+		Timeout:       timeout,
+		EjectAfter:    2,
+		EjectCooldown: cooldown,
+	})
+	require.NoError(t, err)
+
+	// send n requests and count responses by body
+	send := func(n int) map[string]int {
+		bodies := map[string]int{}
+		for i := 0; i < n; i++ {
+			res := doRequest(t, h, http.MethodGet, nil)
+			body, err := ioutil.ReadAll(res.Body)
+			require.NoError(t, err)
+			bodies[string(body)]++
+		}
+		return bodies
+	}
+
+	// second failure of the flaky upstream ejects it
+	require.Equal(t, map[string]int{"healthy": 2, "": 2}, send(4))
+	require.Equal(t, map[string]int{"healthy": 4}, send(4), "traffic must only flow to the healthy upstream")
+
+	// after the cooldown it's probed, and a failed probe ejects it again
+	time.Sleep(cooldown)
+	require.Equal(t, map[string]int{"healthy": 3, "": 1}, send(4))
+
+	// once recovered, it's back in rotation
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(cooldown)
+	require.Equal(t, map[string]int{"healthy": 2, "flaky": 2}, send(4))
+}
+
+func TestAllUpstreamsEjected(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	target.Close()
+
+	var lastErr error
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		Targets:       []string{target.URL},
+		Timeout:       timeout,
+		Callback:      func(status int, err error) { lastErr = err },
+		EjectAfter:    1,
+		EjectCooldown: time.Minute,
+	})
+	require.NoError(t, err)
+
+	// the failure ejects the only upstream
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusBadGateway, w.Code)
+	require.NotEqual(t, proxy.ErrNoHealthyUpstream, lastErr)
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, proxy.ErrNoHealthyUpstream, lastErr)
+}
+
+func TestStickySessions(t *testing.T) {
+	servers := map[string]*httptest.Server{}
+	var targets []string
+	for _, name := range []string{"first", "second", "third"} {
+		servers[name] = newNamedServer(name)
+		defer servers[name].Close()
+		targets = append(targets, servers[name].URL)
+	}
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		Targets:       targets,
+		Timeout:       timeout,
+		StickyCookie:  "backend",
+		EjectAfter:    1,
+		EjectCooldown: time.Minute,
+	})
+	require.NoError(t, err)
+
+	prx := httptest.NewServer(h)
+	defer prx.Close()
+
+	newClient := func() *http.Client {
+		jar, err := cookiejar.New(nil)
+		require.NoError(t, err)
+		return &http.Client{Jar: jar}
+	}
+	get := func(client *http.Client) (int, string) {
+		res, err := client.Get(prx.URL)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(body)
+	}
+
+	alice, bob := newClient(), newClient()
+	_, pinned := get(alice)
+	_, other := get(bob)
+	require.NotEqual(t, pinned, other, "new clients are balanced")
+	for i := 0; i < 5; i++ {
+		_, name := get(alice)
+		require.Equal(t, pinned, name)
+		_, name = get(bob)
+		require.Equal(t, other, name)
+	}
+
+	// the pinned upstream going away ejects it, and the client moves on
+	servers[pinned].Close()
+	status, _ := get(alice)
+	require.Equal(t, http.StatusBadGateway, status)
+	status, moved := get(alice)
+	require.Equal(t, http.StatusOK, status)
+	require.NotEqual(t, pinned, moved)
+	for i := 0; i < 3; i++ {
+		_, name := get(alice)
+		require.Equal(t, moved, name)
+	}
+}
+
+func TestWeightedBalancing(t *testing.T) {
+	heavy := newNamedServer("heavy")
+	defer heavy.Close()
+	medium := newNamedServer("medium")
+	defer medium.Close()
+	light := newNamedServer("light")
+	defer light.Close()
+	disabled := newNamedServer("disabled")
+	defer disabled.Close()
+
+	h, err := proxy.NewWeightedHandler([]proxy.WeightedTarget{
+		{URL: heavy.URL, Weight: 5},
+		{URL: medium.URL, Weight: 3},
+		{URL: light.URL, Weight: 1},
+		{URL: disabled.URL, Weight: 0},
+	}, timeout, nil, nil)
+	require.NoError(t, err)
+
+	counts := map[string]int{}
+	var previous string
+	run := 0
+	for i := 0; i < 900; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		name := rec.Body.String()
+		counts[name]++
+
+		// smooth selection interleaves the heavy upstream with the others
+		if name == previous {
+			run++
+		} else {
+			run = 1
+		}
+		require.LessOrEqual(t, run, 2, "%s picked %d times in a row", name, run)
+		previous = name
+	}
+
+	require.Equal(t, map[string]int{"heavy": 500, "medium": 300, "light": 100}, counts)
+}
+
+func TestWeightedHandlerInvalidTargets(t *testing.T) {
+	cases := map[string][]proxy.WeightedTarget{
+		"none":            nil,
+		"negative weight": {{URL: "http://localhost", Weight: -1}},
+		"all disabled":    {{URL: "http://localhost", Weight: 0}},
+		"relative URL":    {{URL: "/relative", Weight: 1}},
+	}
+	for name, targets := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := proxy.NewWeightedHandler(targets, timeout, nil, nil)
+			require.Error(t, err)
+		})
+	}
+
+	_, err := proxy.NewHandlerWithConfig(proxy.Config{
+		Targets:         []string{"http://localhost"},
+		WeightedTargets: []proxy.WeightedTarget{{URL: "http://localhost", Weight: 1}},
+		Timeout:         timeout,
+	})
+	require.Error(t, err)
+}
+
+// blockingServer holds requests until release is closed, counting those
+// arrived on arrivals
+type blockingServer struct {
+	*httptest.Server
+	arrived int32
+}
+
+func newBlockingServer(release <-chan struct{}, arrivals chan<- struct{}) *blockingServer {
+	s := &blockingServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.arrived, 1)
+		arrivals <- struct{}{}
+		<-release
+	}))
+	return s
+}
+
+func TestLeastConnBalancing(t *testing.T) {
+	cases := map[string]struct {
+		weights  []int
+		requests int
+		expected []int32
+	}{
+		"even":     {[]int{1, 1, 1}, 9, []int32{3, 3, 3}},
+		"weighted": {[]int{2, 1}, 6, []int32{4, 2}},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			release := make(chan struct{})
+			arrivals := make(chan struct{})
+
+			var servers []*blockingServer
+			var targets []proxy.WeightedTarget
+			for _, w := range c.weights {
+				s := newBlockingServer(release, arrivals)
+				defer s.Close()
+				servers = append(servers, s)
+				targets = append(targets, proxy.WeightedTarget{URL: s.URL, Weight: w})
+			}
+
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				WeightedTargets: targets,
+				Timeout:         timeout,
+				Strategy:        proxy.StrategyLeastConn,
+			})
+			require.NoError(t, err)
+
+			// every request stays in flight, so each goes to the least loaded upstream
+			var wg sync.WaitGroup
+			for i := 0; i < c.requests; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+				}()
+				<-arrivals
+			}
+			for i, s := range servers {
+				require.Equal(t, c.expected[i], atomic.LoadInt32(&s.arrived), "upstream %d", i)
+			}
+			close(release)
+			wg.Wait()
+		})
+	}
+}
+
+func TestLeastConnUnevenDurations(t *testing.T) {
+	for name, c := range map[string]struct {
+		strategy proxy.Strategy
+		slow     int32
+	}{
+		"least connections": {proxy.StrategyLeastConn, 1},
+		"round-robin":       {proxy.StrategyRoundRobin, 5},
+	} {
+		t.Run(name, func(t *testing.T) {
+			release := make(chan struct{})
+			arrivals := make(chan struct{})
+			slow := newBlockingServer(release, arrivals)
+			defer slow.Close()
+			fast := newNamedServer("fast")
+			defer fast.Close()
+
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				Targets:  []string{slow.URL, fast.URL},
+				Timeout:  timeout,
+				Strategy: c.strategy,
+			})
+			require.NoError(t, err)
+
+			// requests to the slow upstream pile up, while the fast one keeps up
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				done := make(chan struct{})
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer close(done)
+					h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+				}()
+				select {
+				case <-arrivals:
+				case <-done:
+				}
+			}
+			require.Equal(t, c.slow, atomic.LoadInt32(&slow.arrived))
+			close(release)
+			wg.Wait()
+		})
+	}
+}
+
+func TestEjectionIgnoresReplays(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		Targets:         []string{target.URL},
+		Timeout:         timeout,
+		CacheMaxEntries: 10,
+		EjectAfter:      2,
+		EjectCooldown:   time.Minute,
+	})
+	require.NoError(t, err)
+
+	status := func(path string) int {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusOK, status("/page"))
+	require.Equal(t, http.StatusInternalServerError, status("/fail"))
+	// a cache hit says nothing about the upstream, the failures still add up
+	require.Equal(t, http.StatusOK, status("/page"))
+	require.Equal(t, http.StatusInternalServerError, status("/fail"))
+	require.Equal(t, http.StatusServiceUnavailable, status("/page"), "the upstream must be ejected")
+}
+
+func TestLeastConnCountsRoundTrips(t *testing.T) {
+	release := make(chan struct{})
+	arrivals := make(chan struct{})
+	target := newBlockingServer(release, arrivals)
+	defer target.Close()
+
+	p, err := proxy.NewProxy(proxy.Config{
+		Targets:       []string{target.URL},
+		Timeout:       timeout,
+		Strategy:      proxy.StrategyLeastConn,
+		BufferRequest: true,
+	})
+	require.NoError(t, err)
+
+	upstreamInFlight := func() int64 {
+		rec := httptest.NewRecorder()
+		proxy.NewDebugHandler(p)(rec, httptest.NewRequest(http.MethodGet, "/debug", nil))
+		var doc struct {
+			Upstreams []struct {
+				InFlight int64 `json:"in_flight"`
+			} `json:"upstreams"`
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&doc))
+		return doc.Upstreams[0].InFlight
+	}
+
+	// a client still sending the body it's buffered from loads no upstream
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", pr))
+	}()
+	require.Eventually(t, func() bool { return p.InFlight() == 1 }, timeout, time.Millisecond)
+	require.Zero(t, upstreamInFlight())
+
+	// but once the upstream has it, the request counts until it's done
+	require.NoError(t, pw.Close())
+	<-arrivals
+	require.EqualValues(t, 1, upstreamInFlight())
+	close(release)
+	<-done
+	require.Zero(t, upstreamInFlight())
+}
+
+func TestLeastConnReplacedBody(t *testing.T) {
+	target := newNamedServer("upstream")
+	defer target.Close()
+
+	p, err := proxy.NewProxy(proxy.Config{
+		Targets:  []string{target.URL},
+		Timeout:  timeout,
+		Strategy: proxy.StrategyLeastConn,
+		ModifyResponse: func(res *http.Response) error {
+			// the upstream body is dropped without being closed
+			res.Body = io.NopCloser(strings.NewReader("replaced"))
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, "replaced", w.Body.String())
+
+	rec := httptest.NewRecorder()
+	proxy.NewDebugHandler(p)(rec, httptest.NewRequest(http.MethodGet, "/debug", nil))
+	var doc struct {
+		Upstreams []struct {
+			InFlight int64 `json:"in_flight"`
+		} `json:"upstreams"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&doc))
+	require.Zero(t, doc.Upstreams[0].InFlight, "the round trip must end with the request")
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// request bodies kept in memory by Config.BufferRequest, larger ones go to a
+// temporary file
+const defaultBufferMemoryBytes = 1 << 20
+
+// bufferedBody is a request body read completely before it's sent upstream.
+// It's kept in memory up to a limit, and in a temporary file beyond it
+type bufferedBody struct {
+	io.Reader
+	size int64
+	file *os.File
+}
+
+// bufferBody reads r to the end, keeping up to memLimit bytes in memory. The
+// returned body must be closed to remove its temporary file
+func bufferBody(r io.Reader, memLimit int64) (*bufferedBody, error) {
+	var mem bytes.Buffer
+	n, err := io.CopyN(&mem, r, memLimit)
+	if err == io.EOF {
+		return &bufferedBody{Reader: &mem, size: n}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the body may go on beyond the limit
+	file, err := os.CreateTemp("", "proxy-body-")
+	if err != nil {
+		return nil, err
+	}
+	b := &bufferedBody{size: n, file: file}
+	rest, err := io.Copy(file, r)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	b.size += rest
+	b.Reader = io.MultiReader(&mem, file)
+	return b, nil
+}
+
+// Close removes the temporary file of the body, if any
+func (b *bufferedBody) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	return removeFile(b.file)
+}
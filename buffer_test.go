@@ -0,0 +1,139 @@
+package proxy_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferRequest(t *testing.T) {
+	for name, memory := range map[string]int64{"in memory": 0, "in a temporary file": 4} {
+		t.Run(name, func(t *testing.T) {
+			// temporary files must be gone once the request is done
+			tmp := t.TempDir()
+			t.Setenv("TMPDIR", tmp)
+
+			var conns int32
+			var length int64
+			target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				length = r.ContentLength
+				validateBody(t, r.Body, requestBody+requestBody)
+			}))
+			target.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					atomic.AddInt32(&conns, 1)
+				}
+			}
+			target.Start()
+			defer target.Close()
+
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL:         target.URL,
+				Timeout:           timeout,
+				BufferRequest:     true,
+				BufferMemoryBytes: memory,
+			})
+			require.NoError(t, err)
+
+			prx := httptest.NewServer(h)
+			defer prx.Close()
+
+			// the client sends its body in two parts, with a pause in between
+			pr, pw := io.Pipe()
+			done := make(chan *http.Response)
+			go func() {
+				res, err := http.Post(prx.URL, "text/plain", pr)
+				require.NoError(t, err)
+				done <- res
+			}()
+
+			_, err = io.WriteString(pw, requestBody)
+			require.NoError(t, err)
+			time.Sleep(100 * time.Millisecond)
+			require.Zero(t, atomic.LoadInt32(&conns), "the upstream must not be contacted before the body is complete")
+
+			_, err = io.WriteString(pw, requestBody)
+			require.NoError(t, err)
+			require.NoError(t, pw.Close())
+
+			res := <-done
+			res.Body.Close()
+			require.Equal(t, http.StatusOK, res.StatusCode)
+			require.Equal(t, int64(2*len(requestBody)), length, "the buffered body is sent with its length")
+			require.Equal(t, int32(1), atomic.LoadInt32(&conns))
+
+			files, err := ioutil.ReadDir(tmp)
+			require.NoError(t, err)
+			require.Empty(t, files)
+		})
+	}
+}
+
+func TestBufferRequestTooLarge(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:           target.URL,
+		Timeout:             timeout,
+		BufferRequest:       true,
+		BufferMemoryBytes:   4,
+		MaxRequestBodyBytes: 8,
+	})
+	require.NoError(t, err)
+
+	prx := httptest.NewServer(h)
+	defer prx.Close()
+
+	// without a length, the limit is only hit while buffering
+	res, err := http.Post(prx.URL, "text/plain", io.MultiReader(strings.NewReader(strings.Repeat("x", 20))))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+	require.Zero(t, atomic.LoadInt32(&hits))
+
+	files, err := ioutil.ReadDir(os.Getenv("TMPDIR"))
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestBufferRequestStoreFailure(t *testing.T) {
+	// the body can't be stored, which isn't the client's fault
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:         target.URL,
+		Timeout:           timeout,
+		BufferRequest:     true,
+		BufferMemoryBytes: 4,
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(requestBody))
+	w := httptest.NewRecorder()
+	h(w, req)
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.Zero(t, atomic.LoadInt32(&hits))
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ErrOverloaded is returned for requests over Config.MaxConcurrent
+var ErrOverloaded = errors.New("proxy: too many concurrent requests")
+
+// OverflowMode tells what happens to requests over Config.MaxConcurrent
+type OverflowMode int
+
+const (
+	// OverflowWait queues requests until one in flight finishes, for up to
+	// Config.QueueTimeout, and then answers with 503
+	OverflowWait OverflowMode = iota
+	// OverflowReject answers with 503 right away
+	OverflowReject
+	// OverflowTooManyRequests answers with 429 right away
+	OverflowTooManyRequests
+)
+
+// bulkhead is a semaphore bounding the requests in flight to the upstream
+type bulkhead chan struct{}
+
+// newBulkhead creates bulkhead letting n requests through at a time. It
+// returns nil when n is not positive, for no limit
+func newBulkhead(n int) bulkhead {
+	if n <= 0 {
+		return nil
+	}
+	return make(bulkhead, n)
+}
+
+// acquire a slot for the request of ctx, which must be released once done.
+// When queued, d tells for how long
+func (b bulkhead) acquire(ctx context.Context, d *Data, cfg *Config) error {
+	select {
+	case b <- struct{}{}:
+		return nil
+	default:
+	}
+
+	switch cfg.ConcurrencyOverflow {
+	case OverflowReject:
+		return &rejection{status: http.StatusServiceUnavailable, err: ErrOverloaded}
+	case OverflowTooManyRequests:
+		return &rejection{status: http.StatusTooManyRequests, err: ErrOverloaded}
+	}
+
+	d.Queued = true
+	start := time.Now()
+	defer func() { d.QueueWait = time.Since(start) }()
+
+	timer := time.NewTimer(cfg.orDefault(cfg.QueueTimeout))
+	defer timer.Stop()
+	select {
+	case b <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return &rejection{status: http.StatusServiceUnavailable, err: ErrOverloaded}
+	case <-ctx.Done():
+		// nobody is left to answer
+		return &rejection{status: http.StatusServiceUnavailable, err: ctx.Err()}
+	}
+}
+
+// release the slot of a finished request
+func (b bulkhead) release() {
+	<-b
+}
@@ -0,0 +1,129 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// upstream blocking until release is closed, tracking the most requests it
+// had in flight at once
+type blockingUpstream struct {
+	*httptest.Server
+	release           chan struct{}
+	inFlight, maxSeen int32
+}
+
+func newBlockingUpstream() *blockingUpstream {
+	u := &blockingUpstream{release: make(chan struct{})}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&u.inFlight, 1)
+		defer atomic.AddInt32(&u.inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&u.maxSeen)
+			if n <= max || atomic.CompareAndSwapInt32(&u.maxSeen, max, n) {
+				break
+			}
+		}
+		<-u.release
+	}))
+	return u
+}
+
+func TestMaxConcurrentWait(t *testing.T) {
+	const requests = 6
+	mchan := make(chan proxy.Data, requests)
+
+	target := newBlockingUpstream()
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:     target.URL,
+		Timeout:       timeout,
+		DataChan:      mchan,
+		MaxConcurrent: 2,
+		QueueTimeout:  time.Minute,
+	})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	codes := make([]int, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			codes[i] = w.Code
+		}(i)
+	}
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&target.inFlight) == 2 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(target.release)
+	wg.Wait()
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&target.maxSeen))
+	queued := 0
+	for i := 0; i < requests; i++ {
+		require.Equal(t, http.StatusOK, codes[i])
+		if d := <-mchan; d.Queued {
+			queued++
+			require.True(t, d.QueueWait > 0)
+		}
+	}
+	require.Equal(t, requests-2, queued)
+}
+
+func TestMaxConcurrentOverflow(t *testing.T) {
+	cases := map[string]struct {
+		mode   proxy.OverflowMode
+		queue  time.Duration
+		status int
+	}{
+		"reject":            {proxy.OverflowReject, 0, http.StatusServiceUnavailable},
+		"too many requests": {proxy.OverflowTooManyRequests, 0, http.StatusTooManyRequests},
+		"queue timeout":     {proxy.OverflowWait, 20 * time.Millisecond, http.StatusServiceUnavailable},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			mchan := make(chan proxy.Data, 1)
+
+			target := newBlockingUpstream()
+			defer target.Close()
+
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL:           target.URL,
+				Timeout:             timeout,
+				DataChan:            mchan,
+				MaxConcurrent:       1,
+				ConcurrencyOverflow: c.mode,
+				QueueTimeout:        c.queue,
+			})
+			require.NoError(t, err)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			}()
+			require.Eventually(t, func() bool { return atomic.LoadInt32(&target.inFlight) == 1 }, time.Second, time.Millisecond)
+
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			require.Equal(t, c.status, w.Code)
+			require.Len(t, mchan, 0, "refused requests must not be published")
+
+			close(target.release)
+			<-done
+			require.Len(t, mchan, 1)
+		})
+	}
+}
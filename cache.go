@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// largest response body kept in the cache, larger ones are not cached
+const maxCachedBodyBytes = 1 << 20
+
+// responseCache keeps upstream responses in memory, evicting the least
+// recently used ones beyond maxEntries
+type responseCache struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// most recently used first
+	lru *list.List
+}
+
+// cacheEntry is a cached response
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+	// incomplete is set for the response to an idempotent request that
+	// couldn't be stored whole, which is not replayed
+	incomplete bool
+}
+
+// newResponseCache creates responseCache holding up to maxEntries responses.
+// It returns nil when maxEntries is not positive, for no cache
+func newResponseCache(maxEntries int) *responseCache {
+	if maxEntries <= 0 {
+		return nil
+	}
+
+	return &responseCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// get returns the entry stored under key, unless it expired at now
+func (c *responseCache) get(key string, now time.Time) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
+
+func (c *responseCache) put(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	if c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// response to req rebuilt from e
+func (e *cacheEntry) response(req *http.Request) *http.Response {
+	return &http.Response{
+		StatusCode:    e.status,
+		Header:        e.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// cacheableRequest reports whether the response to r may be served from, and
+// stored into, a cache shared by all clients. Requests with credentials, like
+// cookies, may get responses personalised for them
+func cacheableRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.Header.Get("Authorization") == "" && r.Header.Get("Cookie") == "" && r.Header.Get("Range") == ""
+}
+
+// cacheKey of the response to r, the request as sent upstream. Responses may
+// only vary by Accept-Encoding, which is always part of the key
+func cacheKey(r *http.Request) string {
+	return r.Method + " " + r.Host + r.URL.RequestURI() + "\x00" + r.Header.Get("Accept-Encoding")
+}
+
+// cacheTTL returns how long res may be cached for, as told by its max-age
+func cacheTTL(res *http.Response) (time.Duration, bool) {
+	// a cookie set for one client must not be handed to the others
+	if res.StatusCode != http.StatusOK || len(res.Header.Values("Set-Cookie")) > 0 {
+		return 0, false
+	}
+	for _, v := range res.Header.Values("Vary") {
+		for _, h := range strings.Split(v, ",") {
+			if !strings.EqualFold(strings.TrimSpace(h), "Accept-Encoding") {
+				return 0, false
+			}
+		}
+	}
+
+	var ttl time.Duration
+	for _, v := range res.Header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.ToLower(strings.TrimSpace(directive)), "=")
+			switch name {
+			case "no-store", "no-cache", "private":
+				return 0, false
+			case "max-age":
+				seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+				if err != nil {
+					return 0, false
+				}
+				ttl = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return ttl, ttl > 0
+}
+
+// cachingTransport serves the response of a single request from the cache,
+// or stores the upstream one into it
+type cachingTransport struct {
+	next  http.RoundTripper
+	cache *responseCache
+	key   string
+	d     *Data
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	now := time.Now()
+	if e := t.cache.get(t.key, now); e != nil {
+		t.d.CacheHit = true
+		// the upstream was not contacted
+		t.d.Upstream = ""
+		t.d.UpstreamURL = ""
+
+		res := e.response(req)
+		res.Header.Set("Age", strconv.Itoa(int(now.Sub(e.stored).Seconds())))
+		return res, nil
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if ttl, ok := cacheTTL(res); ok {
+		res.Body = &cacheRecorder{
+			ReadCloser: res.Body,
+			cache:      t.cache,
+			buf:        captureBuffer{limit: maxCachedBodyBytes},
+			entry:      &cacheEntry{key: t.key, status: res.StatusCode, header: res.Header.Clone(), stored: now, expires: now.Add(ttl)},
+		}
+	}
+	return res, nil
+}
+
+// cacheRecorder stores the response body it reads through into the cache,
+// once it was read completely
+type cacheRecorder struct {
+	io.ReadCloser
+	cache *responseCache
+	buf   captureBuffer
+	entry *cacheEntry
+}
+
+func (c *cacheRecorder) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.buf.Write(p[:n])
+	if err == io.EOF && c.entry != nil && !c.buf.truncated {
+		c.entry.body = c.buf.Bytes()
+		c.cache.put(c.entry)
+		c.entry = nil
+	}
+	return n, err
+}
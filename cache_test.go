@@ -0,0 +1,158 @@
+package proxy_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// upstream server counting its requests, responding with the count and
+// the given Cache-Control
+func newCountingServer(cacheControl string) (*httptest.Server, *int32) {
+	var calls int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", cacheControl)
+		fmt.Fprintf(w, "response %d", n)
+	})), &calls
+}
+
+func newCachingHandler(t *testing.T, target string, mchan chan proxy.Data, maxEntries int) http.HandlerFunc {
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:       target,
+		Timeout:         timeout,
+		DataChan:        mchan,
+		CacheMaxEntries: maxEntries,
+	})
+	require.NoError(t, err)
+	return h
+}
+
+func fetch(h http.Handler, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestCacheHit(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+	target, calls := newCountingServer("public, max-age=60")
+	defer target.Close()
+
+	h := newCachingHandler(t, target.URL, mchan, 10)
+
+	w := fetch(h, "/page")
+	require.Equal(t, "response 1", w.Body.String())
+	require.False(t, (<-mchan).CacheHit)
+
+	w = fetch(h, "/page")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "response 1", w.Body.String())
+	require.Equal(t, "0", w.Header().Get("Age"))
+	data := <-mchan
+	require.True(t, data.CacheHit)
+	require.Empty(t, data.Upstream)
+	require.Equal(t, int32(1), atomic.LoadInt32(calls), "hits must not reach the upstream")
+
+	// other URLs miss
+	require.Equal(t, "response 2", fetch(h, "/other").Body.String())
+	require.False(t, (<-mchan).CacheHit)
+}
+
+func TestCacheExpiry(t *testing.T) {
+	target, _ := newCountingServer("max-age=1")
+	defer target.Close()
+
+	h := newCachingHandler(t, target.URL, nil, 10)
+
+	require.Equal(t, "response 1", fetch(h, "/").Body.String())
+	require.Equal(t, "response 1", fetch(h, "/").Body.String())
+	time.Sleep(1100 * time.Millisecond)
+	require.Equal(t, "response 2", fetch(h, "/").Body.String())
+}
+
+func TestCacheNoStore(t *testing.T) {
+	target, calls := newCountingServer("no-store, max-age=60")
+	defer target.Close()
+
+	h := newCachingHandler(t, target.URL, nil, 10)
+
+	require.Equal(t, "response 1", fetch(h, "/").Body.String())
+	require.Equal(t, "response 2", fetch(h, "/").Body.String())
+	require.Equal(t, int32(2), atomic.LoadInt32(calls))
+}
+
+func TestCacheEviction(t *testing.T) {
+	target, _ := newCountingServer("max-age=60")
+	defer target.Close()
+
+	h := newCachingHandler(t, target.URL, nil, 2)
+
+	require.Equal(t, "response 1", fetch(h, "/a").Body.String())
+	require.Equal(t, "response 2", fetch(h, "/b").Body.String())
+	// /a becomes the most recently used, so /b is evicted for /c
+	require.Equal(t, "response 1", fetch(h, "/a").Body.String())
+	require.Equal(t, "response 3", fetch(h, "/c").Body.String())
+	require.Equal(t, "response 1", fetch(h, "/a").Body.String())
+	require.Equal(t, "response 4", fetch(h, "/b").Body.String())
+}
+
+func TestCacheVary(t *testing.T) {
+	target, _ := newCountingServer("max-age=60")
+	defer target.Close()
+
+	h := newCachingHandler(t, target.URL, nil, 10)
+
+	send := func(encoding string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w.Body.String()
+	}
+
+	require.Equal(t, "response 1", send("gzip"))
+	require.Equal(t, "response 2", send("identity"))
+	require.Equal(t, "response 1", send("gzip"))
+}
+
+func TestCacheCookies(t *testing.T) {
+	var calls int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: fmt.Sprint(n)})
+		}
+		fmt.Fprintf(w, "response %d for %q", n, r.Header.Get("Cookie"))
+	}))
+	defer target.Close()
+
+	h := newCachingHandler(t, target.URL, nil, 10)
+
+	// responses setting cookies are not stored
+	first := fetch(h, "/login")
+	second := fetch(h, "/login")
+	require.Equal(t, "session=1", first.Header().Get("Set-Cookie"))
+	require.Equal(t, "session=2", second.Header().Get("Set-Cookie"))
+
+	// nor served to or stored for requests sending them
+	send := func(cookie string) string {
+		req := httptest.NewRequest(http.MethodGet, "/account", nil)
+		req.Header.Set("Cookie", cookie)
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w.Body.String()
+	}
+	require.Equal(t, `response 3 for "session=1"`, send("session=1"))
+	require.Equal(t, `response 4 for "session=2"`, send("session=2"))
+	require.Equal(t, `response 5 for ""`, fetch(h, "/account").Body.String())
+	require.Equal(t, `response 5 for ""`, fetch(h, "/account").Body.String())
+	require.Equal(t, `response 6 for "session=1"`, send("session=1"))
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP finds the address of the client that sent r. X-Forwarded-For is
+// walked from the right, as long as the hops are trusted, so that addresses
+// prepended by the client itself are never taken for its own
+func clientIP(r *http.Request, trusted []net.IPNet) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	peer := net.ParseIP(ip)
+	if peer == nil || !isTrusted(peer, trusted) {
+		return ip
+	}
+
+	var chain []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		chain = append(chain, strings.Split(v, ",")...)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(chain[i]))
+		if hop == nil {
+			// a malformed entry breaks the chain, the last hop is all we know
+			break
+		}
+		ip = hop.String()
+		if !isTrusted(hop, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+// isTrusted reports whether ip belongs to one of the trusted networks
+func isTrusted(ip net.IP, trusted []net.IPNet) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package proxy_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	_, internal, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		"direct":          {"203.0.113.7:1234", "", "203.0.113.7"},
+		"trusted chain":   {"10.0.0.1:1234", "198.51.100.2, 203.0.113.7, 10.0.0.2", "203.0.113.7"},
+		"all trusted":     {"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		"spoofed header":  {"203.0.113.7:1234", "198.51.100.2", "203.0.113.7"},
+		"malformed entry": {"10.0.0.1:1234", "203.0.113.7, bogus", "10.0.0.1"},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			mchan := make(chan proxy.Data, 1)
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL:      target.URL,
+				Timeout:        timeout,
+				DataChan:       mchan,
+				TrustedProxies: []net.IPNet{*internal},
+			})
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tc.forwarded)
+			}
+			h(httptest.NewRecorder(), req)
+
+			require.Equal(t, tc.expected, (<-mchan).ClientIP)
+		})
+	}
+}
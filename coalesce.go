@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// headers of requests the upstream response may depend on, identical
+// requests must agree on all of them to share a response
+var coalesceHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie", "Range"}
+
+// coalescer lets identical requests in flight share a single upstream round
+// trip, see Config.Coalesce. It's golang.org/x/sync/singleflight cut down,
+// as the module isn't a dependency for the few lines it would save. Unlike
+// there, the call is finished once the response headers are in when the
+// body can't be shared, and the waiting requests then send their own
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is a round trip shared by identical requests. Once done is
+// closed, it holds the response to replay, or the error to report. Neither is
+// set when the response couldn't be shared
+type coalescedCall struct {
+	done  chan struct{}
+	entry *cacheEntry
+	err   error
+}
+
+// newCoalescer creates coalescer, or returns nil when not enabled
+func newCoalescer(enabled bool) *coalescer {
+	if !enabled {
+		return nil
+	}
+	return &coalescer{calls: make(map[string]*coalescedCall)}
+}
+
+// coalescable reports whether r may share the response of an identical
+// request: its method is safe and it has no body
+func coalescable(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.ContentLength == 0 && len(r.TransferEncoding) == 0
+}
+
+// coalesceKey identifies the requests sharing a response with r, the request
+// as sent upstream
+func coalesceKey(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method + " " + r.Host + r.URL.RequestURI())
+	for _, name := range coalesceHeaders {
+		b.WriteByte(0)
+		b.WriteString(strings.Join(r.Header.Values(name), ", "))
+	}
+	return b.String()
+}
+
+// join returns the call in flight for key, or starts one the caller leads
+// and must finish
+func (c *coalescer) join(key string) (*coalescedCall, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if call, ok := c.calls[key]; ok {
+		return call, false
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	return call, true
+}
+
+// finish the call for key, handing its outcome to the requests waiting for it.
+// Requests arriving from now on start a call of their own
+func (c *coalescer) finish(key string, call *coalescedCall) {
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+
+	close(call.done)
+}
+
+// coalescingTransport sends a single request upstream, unless an identical
+// one is in flight already, then it waits for its response
+type coalescingTransport struct {
+	next  http.RoundTripper
+	group *coalescer
+	key   string
+	d     *Data
+}
+
+func (t *coalescingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	call, leader := t.group.join(t.key)
+	if leader {
+		return t.lead(call, req)
+	}
+
+	select {
+	case <-call.done:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	if call.entry == nil && call.err == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	t.d.Coalesced = true
+	// the upstream was not contacted
+	t.d.Upstream = ""
+	t.d.UpstreamURL = ""
+	if call.err != nil {
+		return nil, call.err
+	}
+	return call.entry.response(req), nil
+}
+
+// lead sends req upstream and reads the response body, so that it can be
+// replayed to the requests waiting for it. Streamed responses, and ones
+// without a length or larger than 1 MiB, are passed through as they come
+// instead, and the others send requests of their own
+func (t *coalescingTransport) lead(call *coalescedCall, req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err == nil && !bodyless(res) && (streaming(res) || res.ContentLength > maxCachedBodyBytes) {
+		t.group.finish(t.key, call)
+		return res, nil
+	}
+
+	var body []byte
+	if err == nil {
+		if body, err = io.ReadAll(res.Body); err != nil {
+			res.Body.Close()
+		}
+	}
+	if err != nil {
+		// the failure of a request its client gave up on is not the others' to share
+		if req.Context().Err() == nil {
+			call.err = err
+		}
+		t.group.finish(t.key, call)
+		return nil, err
+	}
+
+	res.Body.Close()
+	call.entry = &cacheEntry{status: res.StatusCode, header: res.Header.Clone(), body: body}
+	t.group.finish(t.key, call)
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
@@ -0,0 +1,246 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalesce(t *testing.T) {
+	const requests = 10
+	mchan := make(chan proxy.Data, requests)
+
+	var hits int32
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		w.Header().Set("X-Served-For", r.URL.Path)
+		w.Write([]byte(responseBody))
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL: target.URL,
+		Timeout:   timeout,
+		DataChan:  mchan,
+		Coalesce:  true,
+	})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodGet, "/report", nil))
+			responses[i] = w
+		}(i)
+	}
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&hits) == 1 }, time.Second, time.Millisecond)
+	// give the others the time to pile up behind the first one
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&hits), "the upstream must be contacted once")
+	coalesced := 0
+	for i := 0; i < requests; i++ {
+		require.Equal(t, http.StatusOK, responses[i].Code)
+		require.Equal(t, responseBody, responses[i].Body.String())
+		require.Equal(t, "/report", responses[i].Header().Get("X-Served-For"))
+		data := <-mchan
+		require.NoError(t, data.Error)
+		if data.Coalesced {
+			coalesced++
+			require.Empty(t, data.Upstream)
+		}
+	}
+	require.Equal(t, requests-1, coalesced)
+
+	// requests arriving after the response are sent on their own
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/report", nil))
+	require.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	require.False(t, (<-mchan).Coalesced)
+}
+
+func TestCoalesceDistinct(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{TargetURL: target.URL, Timeout: timeout, Coalesce: true})
+	require.NoError(t, err)
+
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/a", nil),
+		httptest.NewRequest(http.MethodGet, "/a?page=2", nil),
+		httptest.NewRequest(http.MethodHead, "/a", nil),
+		httptest.NewRequest(http.MethodPost, "/a", nil),
+		httptest.NewRequest(http.MethodGet, "/a", strings.NewReader("body")),
+	}
+	authorized := httptest.NewRequest(http.MethodGet, "/a", nil)
+	authorized.Header.Set("Authorization", "Bearer token")
+	requests = append(requests, authorized)
+
+	var wg sync.WaitGroup
+	for _, req := range requests {
+		wg.Add(1)
+		go func(req *http.Request) {
+			defer wg.Done()
+			h(httptest.NewRecorder(), req)
+		}(req)
+	}
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&hits) == int32(len(requests)) }, time.Second, time.Millisecond,
+		"requests differing in method, URL, body or headers must not be coalesced")
+	close(release)
+	wg.Wait()
+}
+
+func TestCoalesceStreaming(t *testing.T) {
+	const requests = 3
+	release := make(chan struct{})
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "data: last\n\n")
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{TargetURL: target.URL, Timeout: timeout, Coalesce: true})
+	require.NoError(t, err)
+	prx := httptest.NewServer(h)
+	defer prx.Close()
+	// let the streams end before the servers wait for them
+	defer close(release)
+
+	// every request gets the first event before the stream ends, rather than
+	// waiting for the first one to be read to the end
+	for i := 0; i < requests; i++ {
+		go func() {
+			res, err := http.Get(prx.URL)
+			if err == nil {
+				defer res.Body.Close()
+				io.Copy(io.Discard, res.Body)
+			}
+		}()
+	}
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Get(prx.URL)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "data: first\n", line)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&hits) == requests+1 }, timeout, time.Millisecond,
+		"streamed responses must not be shared")
+}
+
+func TestCoalesceLeaderCanceled(t *testing.T) {
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			// the first request is held until its client gives up
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte(responseBody))
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{TargetURL: target.URL, Timeout: timeout, Coalesce: true})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/report", nil).WithContext(ctx))
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&hits) == 1 }, time.Second, time.Millisecond)
+
+	followerDone := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/report", nil))
+		followerDone <- w
+	}()
+	// give the follower the time to join the leader
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-leaderDone
+
+	// the cancellation is the leader's own, the follower sends its request again
+	w := <-followerDone
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, responseBody, w.Body.String())
+	require.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
+
+func TestCoalesceTooLarge(t *testing.T) {
+	const requests = 3
+	mchan := make(chan proxy.Data, requests)
+
+	largeBody := strings.Repeat("x", 2<<20)
+	var hits int32
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			<-release
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(largeBody)))
+		w.Write([]byte(largeBody))
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{TargetURL: target.URL, Timeout: timeout, DataChan: mchan, Coalesce: true})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodGet, "/download", nil))
+			responses[i] = w
+		}(i)
+	}
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&hits) == 1 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// a response too large to keep isn't shared, every request gets its own
+	require.Equal(t, int32(requests), atomic.LoadInt32(&hits))
+	for i := 0; i < requests; i++ {
+		require.Equal(t, http.StatusOK, responses[i].Code)
+		require.Equal(t, len(largeBody), responses[i].Body.Len())
+		require.False(t, (<-mchan).Coalesced)
+	}
+}
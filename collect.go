@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+)
+
+// Collect reads n items from ch, waiting at most timeout in total. It is
+// meant for tests of Data consumers. If the timeout expires or ch is closed
+// first, the items read so far are returned with an error
+func Collect(ch <-chan Data, n int, timeout time.Duration) ([]Data, error) {
+	items := make([]Data, 0, n)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for len(items) < n {
+		select {
+		case d, ok := <-ch:
+			if !ok {
+				return items, fmt.Errorf("proxy: data channel closed after %d of %d items", len(items), n)
+			}
+			items = append(items, d)
+		case <-timer.C:
+			return items, fmt.Errorf("proxy: timed out after %s waiting for data, got %d of %d items", timeout, len(items), n)
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,48 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollect(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	ch := make(chan proxy.Data, 3)
+	h, err := proxy.NewHandler(target.URL, timeout, ch, nil)
+	require.NoError(t, err)
+
+	for _, id := range []string{"a", "b", "c"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Request-ID", id)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	items, err := proxy.Collect(ch, 2, time.Second)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	require.Equal(t, "a", items[0].RequestID)
+	require.Equal(t, "b", items[1].RequestID)
+
+	// only one item is left
+	items, err = proxy.Collect(ch, 2, 50*time.Millisecond)
+	require.Error(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, "c", items[0].RequestID)
+}
+
+func TestCollectClosed(t *testing.T) {
+	ch := make(chan proxy.Data, 1)
+	ch <- proxy.Data{StatusCode: http.StatusOK}
+	close(ch)
+
+	items, err := proxy.Collect(ch, 2, time.Second)
+	require.ErrorContains(t, err, "closed")
+	require.Len(t, items, 1)
+}
@@ -0,0 +1,532 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maximum of idle upstream connections to keep open
+const httpMaxIdleConns = 256
+
+// how long to wait for an upstream to answer "Expect: 100-continue"
+const defaultExpectContinueTimeout = time.Second
+
+// Config of the proxy handler
+type Config struct {
+	// TargetURL of the upstream server requests are proxied to. URLs like
+	// unix:///var/run/app.sock point to a server listening on a Unix domain
+	// socket, requests are sent to it with the path they came with
+	TargetURL string
+	// Targets are URLs of a pool of upstream servers requests are spread
+	// across, in round-robin order unless Strategy says otherwise. Mutually
+	// exclusive with TargetURL
+	Targets []string
+	// WeightedTargets are a pool of upstream servers like Targets, getting
+	// shares of the requests in proportion to their weights. Mutually
+	// exclusive with TargetURL and Targets
+	WeightedTargets []WeightedTarget
+	// Strategy spreads requests across the pool of Targets or WeightedTargets.
+	// Zero means StrategyWeighted for WeightedTargets, and StrategyRoundRobin
+	// otherwise
+	Strategy Strategy
+	// StickyCookie, when not empty, pins clients to an upstream of the pool
+	// with a cookie of this name, for upstreams keeping session state in
+	// memory. Clients pinned to an ejected upstream are moved to another one
+	StickyCookie string
+	// Timeout for connecting to the upstream and waiting for its response. It's
+	// the default of DialTimeout, ResponseHeaderTimeout and IdleConnTimeout
+	Timeout time.Duration
+	// DialTimeout limits connecting to the upstream
+	DialTimeout time.Duration
+	// ResponseHeaderTimeout limits waiting for the upstream response headers
+	// once the request is sent
+	ResponseHeaderTimeout time.Duration
+	// MaxTimeoutOverride, when positive, lets clients override RequestTimeout
+	// of single requests with an X-Proxy-Timeout header holding a duration,
+	// like "30s", capped at MaxTimeoutOverride. Invalid values are ignored.
+	// The transport timeouts still apply, so ResponseHeaderTimeout must allow
+	// for the longest override
+	MaxTimeoutOverride time.Duration
+	// ClientReadTimeout, when positive, limits reading the request body from
+	// the client. Clients not sending it in time get 408, without publishing Data
+	ClientReadTimeout time.Duration
+	// IdleConnTimeout is how long an idle upstream connection is kept open
+	IdleConnTimeout time.Duration
+	// ExpectContinueTimeout is how long to wait for the upstream to answer
+	// "Expect: 100-continue" before sending the request body anyway. Zero
+	// means one second
+	ExpectContinueTimeout time.Duration
+	// DisableExpectContinue drops the Expect header from upstream requests,
+	// for upstreams mishandling it. Bodies are then sent right away
+	DisableExpectContinue bool
+	// RequestTimeout, when positive, limits the whole upstream exchange,
+	// including reading the response body. Requests running out of it before
+	// the upstream responds get 504, later ones have the response interrupted.
+	// Upgraded connections are not limited
+	RequestTimeout time.Duration
+	// DataChan receives a Data item for every proxied request, including the
+	// ones failing to reach the upstream, with Error and StatusCode set.
+	// Requests refused by the proxy itself, like over a limit, are not published.
+	// When nil, nothing is published and requests are only proxied and logged
+	DataChan chan<- Data
+	// ErrorHandler, when not nil, renders the response to the client for
+	// requests the proxy failed to get a response for, and sets its status.
+	// By default, a plain text status message is sent, without the error details
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+	// Fallback, when not nil, is sent to the client instead when no upstream
+	// could be reached, like a maintenance page. It takes precedence over
+	// ErrorHandler. Data is published as for any failure, with Error set
+	Fallback *FallbackResponse
+	// StatusRewriter, when not nil, maps the status of upstream responses to
+	// the one sent to the client, e.g. to normalize non-standard codes
+	StatusRewriter func(status int) int
+	// Callback, when not nil, is called once per request with the final
+	// status code and the proxy error (nil on success)
+	Callback func(status int, err error)
+	// Transport, when not nil, sends requests upstream instead of the internally
+	// constructed http.Transport. Settings configuring the latter, like
+	// MaxIdleConns, have no effect then
+	Transport http.RoundTripper
+	// TLSConfig for connections to HTTPS upstreams
+	TLSConfig *tls.Config
+	// ClientCertFile and ClientKeyFile are PEM files with the certificate and
+	// key presented to upstreams requiring mutual TLS
+	ClientCertFile string
+	ClientKeyFile  string
+	// CAFile is a PEM bundle of certificate authorities trusted to sign
+	// upstream certificates, instead of the system ones
+	CAFile string
+	// InsecureSkipVerify disables verification of upstream certificates.
+	// DANGER: it makes connections open to man-in-the-middle attacks, only
+	// use it for testing
+	InsecureSkipVerify bool
+	// ForwardClientCert passes the subject and serial number of the verified
+	// certificate of a client connecting over TLS to the upstream, in the
+	// X-Client-Cert-Subject and X-Client-Cert-Serial headers, and the server
+	// name it asked for in X-Client-SNI. Values the client sent itself are
+	// dropped. Only enable it when the handler terminates the client TLS
+	ForwardClientCert bool
+	// ProxyProtocol, when 1 or 2, opens upstream connections with a PROXY
+	// protocol header of that version, carrying the addresses of the client
+	// connection, for upstreams like HAProxy-aware ones. Connections are not
+	// reused then, as each carries the addresses of a single client
+	ProxyProtocol int
+	// EnableHTTP2 lets connections to HTTPS upstreams negotiate HTTP/2
+	EnableHTTP2 bool
+	// MaxConcurrent, when positive, bounds the requests in flight to the
+	// upstreams. Requests over it are handled as ConcurrencyOverflow says,
+	// waiting for up to QueueTimeout, which defaults to Timeout, when queued.
+	// Requests refused are not published
+	MaxConcurrent       int
+	ConcurrencyOverflow OverflowMode
+	QueueTimeout        time.Duration
+	// CacheMaxEntries enables caching GET responses in memory, keeping up to
+	// this many of them. Only 200 responses with a Cache-Control max-age are
+	// cached, until it expires, and never when marked no-store, no-cache or
+	// private, nor when setting cookies. Requests with an Authorization or
+	// Cookie header bypass the cache. Responses may only vary by
+	// Accept-Encoding. Zero disables caching
+	CacheMaxEntries int
+	// IdempotencyTTL enables deduplicating requests with an Idempotency-Key
+	// header: the response to the first one with a key, for the same method,
+	// path and client, is stored for this long and replayed to later ones
+	// without contacting the upstream. Clients are told apart by their
+	// Authorization header, or their address without one. Requests arriving
+	// while the first one is in flight wait for it. Server errors are not
+	// stored, so that clients can retry them. Bodies are stored up to 1 MiB:
+	// when larger, or not read to the end, later requests with the key get 409
+	// rather than taking effect again. Zero disables deduplication
+	IdempotencyTTL time.Duration
+	// Coalesce makes identical GET and HEAD requests in flight at the same
+	// time share a single upstream round trip: the first one is sent, and the
+	// others get copies of its response, or its error. Requests are identical
+	// when their URLs and the headers responses commonly depend on, like
+	// Accept-Encoding, Authorization and Cookie, are. Only responses with a
+	// Content-Length up to 1 MiB are shared, and read completely before being
+	// forwarded. Streamed ones, like Server-Sent Events, reach the first
+	// request as they come, and the others send requests of their own
+	Coalesce bool
+	// MaxIdleConns is the maximum of idle upstream connections to keep open,
+	// defaults to 256
+	MaxIdleConns int
+	// KeepAlive is the interval of TCP keep-alive probes on upstream
+	// connections, independent of the request timeouts. Zero means 15
+	// seconds, like net.Dialer, and a negative interval disables them
+	KeepAlive time.Duration
+	// CaptureRequest and CaptureResponse enable capturing the corresponding
+	// body into Data.Request and Data.Response. When disabled, bodies are
+	// streamed straight through and the Data fields are left nil, so
+	// consumers must nil-check them
+	CaptureRequest  bool
+	CaptureResponse bool
+	// MaxCaptureBytes limits how many bytes of request and response bodies are
+	// captured into Data. Bodies are still proxied in full, only the capture is
+	// truncated. Zero means no limit
+	MaxCaptureBytes int64
+	// CaptureSampleBytes, when positive, captures the first bytes of response
+	// bodies into Data.Response, even with CaptureResponse disabled. It's a
+	// cheap way to peek into large downloads, which still stream in full
+	CaptureSampleBytes int64
+	// Sampling captures the bodies of only a sample of the requests, at
+	// SampleRate. The others still publish Data, without Request and
+	// Response. Clients decide themselves with an X-Trace-Sampled header of
+	// 1 or 0. Without Sampling, every request is sampled
+	Sampling bool
+	// SampleRate is the fraction of requests sampled with Sampling, between
+	// 0 and 1. At zero, only those of clients asking for it are
+	SampleRate float64
+	// CaptureRedactor, when not nil, rewrites the captured request and
+	// response bodies once they are complete, like to mask personal data
+	// before Data is stored. The bytes proxied are left alone
+	CaptureRedactor func(captured []byte) []byte
+	// CaptureSink, when not nil, receives the captured bodies as they're
+	// proxied, instead of Data.Request and Data.Response, which are left nil.
+	// Data.RequestID tells which request they belong to. The capture limits
+	// apply, but the bodies are neither decoded nor redacted. A slow sink
+	// doesn't hold up proxied requests, it misses the rest of the bodies
+	// instead, see CaptureSink
+	CaptureSink CaptureSink
+	// CaptureSpillBytes, when positive, moves captured bodies larger than it
+	// to temporary files instead of memory, to capture large payloads for
+	// audit. Data.Request and Data.Response then read from the file, which is
+	// removed once read to the end, on Data.Close, or after CaptureSpillTTL
+	CaptureSpillBytes int64
+	// CaptureSpillTTL is how long a spilled capture is kept when it's neither
+	// read nor closed. Zero means a minute
+	CaptureSpillTTL time.Duration
+	// MaxRequestBodyBytes rejects requests with larger bodies with 413, without
+	// publishing Data. Zero means no limit
+	MaxRequestBodyBytes int64
+	// MaxResponseBodyBytes, when positive, caps the response bodies sent to
+	// clients. Longer ones are cut off, sent without Content-Length so that the
+	// client sees a complete body, and flagged with Data.ResponseTruncated
+	MaxResponseBodyBytes int64
+	// BufferRequest reads request bodies completely before contacting the
+	// upstream, so that slow clients don't hold upstream connections open.
+	// Bodies are kept in memory up to BufferMemoryBytes, 1MB by default, and
+	// in a temporary file beyond it. MaxRequestBodyBytes still applies
+	BufferRequest     bool
+	BufferMemoryBytes int64
+	// RequestBodyTransform, when not nil, rewrites request bodies before they
+	// are sent upstream and captured. Transformed bodies are sent chunked, as
+	// their length is not known upfront. Failing transforms answer with 500
+	RequestBodyTransform func(body io.Reader) (io.Reader, error)
+	// ResponseBodyTransform, when not nil, rewrites upstream response bodies
+	// before they are sent to the client and captured. Transformed responses
+	// are sent without Content-Length. Failing transforms answer with 500
+	ResponseBodyTransform func(body io.Reader) (io.Reader, error)
+	// CompressResponses gzips uncompressed text, JSON, JavaScript and XML
+	// responses for clients accepting gzip, for upstreams not compressing
+	// their responses themselves. Compressed responses are sent without
+	// Content-Length, and with a strong ETag made weak. Partial content is
+	// never compressed. Data still gets the uncompressed body
+	CompressResponses bool
+	// DecodeCapturedBody decompresses gzip or deflate encoded response bodies
+	// captured into Data.Response. The client still gets the encoded bytes
+	DecodeCapturedBody bool
+	// Retries of upstream requests failing with a connection error. Only
+	// bodyless requests with idempotent methods (GET, HEAD, OPTIONS) are
+	// retried, anything else fails on the first error
+	Retries int
+	// HonorRetryAfter retries bodyless requests with idempotent methods once,
+	// when the upstream answers 503 with a Retry-After of up to MaxRetryAfter,
+	// after waiting for it. MaxRetryAfter defaults to Timeout. Longer waits
+	// pass the 503 on to the client
+	HonorRetryAfter bool
+	MaxRetryAfter   time.Duration
+	// AllowedMethods, when not empty, are the only request methods proxied.
+	// Requests with other methods get 405, without publishing Data
+	AllowedMethods []string
+	// Validate, when not nil, is called before a request is forwarded. If it
+	// returns an error, the client gets 400 with the error message, or the
+	// response of ErrorHandler, and no Data is published
+	Validate func(r *http.Request) error
+	// ModifyRequest, when not nil, is called with the request about to be
+	// sent upstream, once its headers are set. It may change anything, like
+	// the method or the URL, whose host also needs to be set in req.Host to
+	// be sent. If it returns an error, the client gets 500 and no Data is
+	// published
+	ModifyRequest func(req *http.Request) error
+	// ModifyResponse, when not nil, is called with the upstream response
+	// before it's sent to the client. It may change the status, the headers
+	// or wrap or replace the body, the upstream one is closed either way. If
+	// it returns an error, the client gets 502 and the error is published
+	ModifyResponse func(res *http.Response) error
+	// PathAllowlist, when not empty, limits the request paths proxied to those
+	// matching one of its patterns. A pattern with wildcards is matched with
+	// path.Match, so * doesn't cross slashes; any other is a path prefix
+	// matching on segment boundaries. Other requests get 404, without
+	// contacting the upstream or publishing Data. Paths with . or ..
+	// segments, escaped or not, get 400 whether or not there's an allowlist
+	PathAllowlist []string
+	// JSONSchema, when set, is a JSON schema the bodies of requests with
+	// Content-Type application/json, or application/*+json, are validated
+	// against. Invalid bodies, empty ones included, get 422 with the reason,
+	// without contacting the upstream or publishing Data.
+	// JSONSchemaFile reads the schema from a file instead. The built-in
+	// validator supports a subset of the keywords, see NewJSONSchemaValidator.
+	// Bodies are validated up to MaxRequestBodyBytes, or 1 MiB without it,
+	// larger ones get 413
+	JSONSchema     string
+	JSONSchemaFile string
+	// SchemaValidator, when not nil, validates JSON bodies in place of the
+	// built-in validator of JSONSchema
+	SchemaValidator SchemaValidator
+	// SchemaPaths and SchemaMethods limit the requests with validated bodies.
+	// Paths are patterns like those of PathAllowlist, and all are validated
+	// when empty. Methods default to POST, PUT and PATCH
+	SchemaPaths   []string
+	SchemaMethods []string
+	// RateLimit is the number of requests per second each client, told apart
+	// by Data.ClientIP, may make, in bursts of up to RateBurst requests.
+	// Requests over the limit get 429, without publishing Data. Zero means
+	// no limit
+	RateLimit rate.Limit
+	RateBurst int
+	// CORS, when not nil, answers CORS preflight requests without proxying
+	// them or publishing Data, and adds Access-Control-Allow-Origin to the
+	// responses of allowed cross-origin requests
+	CORS *CORS
+	// StripPrefix is removed from the request path before it's sent upstream.
+	// Requests with paths not starting with it get 404
+	StripPrefix string
+	// AddPrefix is prepended to the request path, after StripPrefix is removed
+	AddPrefix string
+	// PreserveHost forwards the Host of the incoming request to the upstream.
+	// By default, the upstream gets the host of its own URL
+	PreserveHost bool
+	// RewriteLocation, on redirects, points an absolute Location at the host
+	// of the upstream to PublicURL instead, mapping its path back to the one
+	// clients use. Relative locations and those to other hosts are left alone
+	RewriteLocation bool
+	// PublicURL is the base URL clients reach the proxy at, like
+	// https://example.com/app. Defaults to the scheme and host of the request,
+	// which is rewritten into the Location of each client on its own, never
+	// into cached or coalesced responses
+	PublicURL string
+	// UserAgent, when not empty, replaces the User-Agent of requests sent
+	// upstream. Otherwise the one of the client is forwarded, and none is sent
+	// for clients without one
+	UserAgent string
+	// SigningSecret, when not nil, is the key of the HMAC-SHA256 signature of
+	// requests sent upstream, hex encoded into SignatureHeader (X-Signature by
+	// default). The signature covers the body as sent, after
+	// RequestBodyTransform, which is read in full before the request is sent.
+	// With SignMethodAndPath, the method and the URI sent upstream, each
+	// followed by a newline, are signed before the body
+	SigningSecret     []byte
+	SignatureHeader   string
+	SignMethodAndPath bool
+	// TrustedProxies are networks of proxies in front of this one, trusted to
+	// report the client address in X-Forwarded-For, see Data.ClientIP
+	TrustedProxies []net.IPNet
+	// DropRequestHeaders are removed from requests before they are sent upstream
+	DropRequestHeaders []string
+	// SetRequestHeaders are set on requests sent upstream, overriding values
+	// sent by the client
+	SetRequestHeaders map[string]string
+	// DropResponseHeaders are removed from upstream responses before they are
+	// sent to the client, like Server or X-Powered-By. Data.ResponseHeader
+	// still holds them
+	DropResponseHeaders []string
+	// EjectAfter consecutive failures (connection errors or 5xx responses)
+	// of an upstream in Targets take it out of rotation for EjectCooldown.
+	// Failures further apart than EjectWindow don't add up, zero window means
+	// failures add up however far apart they are. After the cooldown the
+	// upstream gets traffic again, and is ejected on the first failure until
+	// it succeeds once. Zero disables ejection
+	EjectAfter    int
+	EjectWindow   time.Duration
+	EjectCooldown time.Duration
+	// UnreadyAfter is the number of consecutive failures to reach the
+	// upstream, by proxied requests or readiness probes, making a Proxy
+	// unready again, see Proxy.Ready. Zero means 3
+	UnreadyAfter int
+	// Logger, when not nil, receives a structured access log line per request
+	// with the latency breakdown, whatever LogFormat is, unless it's LogNone
+	Logger *slog.Logger
+	// LogFormat of the access log lines written without a Logger. The zero
+	// value is LogPlain, through the standard logger
+	LogFormat LogFormat
+	// LogOutput receives the LogApache and LogJSON lines. It defaults to the
+	// output of the standard logger
+	LogOutput io.Writer
+	// SlowThreshold, when positive, makes requests taking longer than it in
+	// total log a warning with their latency breakdown, to Logger or else the
+	// standard logger, whatever LogFormat is. Upgraded connections are left out
+	SlowThreshold time.Duration
+}
+
+// validate the settings shared by all handlers. Target URLs are validated
+// separately by parseTarget, as not every handler has a single one
+func (c *Config) validate() error {
+	if c.Timeout <= 0 {
+		return fmt.Errorf("proxy: timeout must be positive, got %s", c.Timeout)
+	}
+	for name, t := range map[string]time.Duration{
+		"dial":            c.DialTimeout,
+		"response header": c.ResponseHeaderTimeout,
+		"idle connection": c.IdleConnTimeout,
+		"request":         c.RequestTimeout,
+		"client read":     c.ClientReadTimeout,
+		"max override":    c.MaxTimeoutOverride,
+		"expect continue": c.ExpectContinueTimeout,
+		"idempotency":     c.IdempotencyTTL,
+		"queue":           c.QueueTimeout,
+		"max retry after": c.MaxRetryAfter,
+		"capture spill":   c.CaptureSpillTTL,
+	} {
+		if t < 0 {
+			return fmt.Errorf("proxy: %s timeout must not be negative, got %s", name, t)
+		}
+	}
+	if c.Fallback != nil {
+		if err := c.Fallback.validate(); err != nil {
+			return err
+		}
+	}
+	if c.RateLimit > 0 && c.RateBurst <= 0 {
+		return fmt.Errorf("proxy: rate burst must be positive, got %d", c.RateBurst)
+	}
+	if c.CacheMaxEntries < 0 {
+		return fmt.Errorf("proxy: max cache entries must not be negative, got %d", c.CacheMaxEntries)
+	}
+	if c.MaxIdleConns < 0 {
+		return fmt.Errorf("proxy: max idle connections must not be negative, got %d", c.MaxIdleConns)
+	}
+	if c.ProxyProtocol < 0 || c.ProxyProtocol > 2 {
+		return fmt.Errorf("proxy: PROXY protocol version must be 1 or 2, got %d", c.ProxyProtocol)
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("proxy: sample rate must be between 0 and 1, got %g", c.SampleRate)
+	}
+	if c.SampleRate != 0 && !c.Sampling {
+		return fmt.Errorf("proxy: sample rate requires sampling")
+	}
+	if c.UnreadyAfter < 0 {
+		return fmt.Errorf("proxy: unready after must not be negative, got %d", c.UnreadyAfter)
+	}
+	if c.EjectAfter > 0 && c.EjectCooldown <= 0 {
+		return fmt.Errorf("proxy: eject cooldown must be positive, got %s", c.EjectCooldown)
+	}
+	if c.ConcurrencyOverflow < OverflowWait || c.ConcurrencyOverflow > OverflowTooManyRequests {
+		return fmt.Errorf("proxy: unknown concurrency overflow mode %d", c.ConcurrencyOverflow)
+	}
+	if c.Strategy < 0 || c.Strategy > StrategyWeighted {
+		return fmt.Errorf("proxy: unknown balancing strategy %d", c.Strategy)
+	}
+	if c.SlowThreshold < 0 {
+		return fmt.Errorf("proxy: slow threshold must not be negative, got %s", c.SlowThreshold)
+	}
+	if c.LogFormat < LogPlain || c.LogFormat > LogNone {
+		return fmt.Errorf("proxy: unknown log format %d", c.LogFormat)
+	}
+	if c.JSONSchema != "" && c.JSONSchemaFile != "" {
+		return errors.New("proxy: JSON schema and JSON schema file are mutually exclusive")
+	}
+	if c.PublicURL != "" {
+		if u, err := url.Parse(c.PublicURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("proxy: public URL %q must be absolute", c.PublicURL)
+		}
+	}
+	for _, patterns := range [][]string{c.PathAllowlist, c.SchemaPaths} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("proxy: invalid path pattern %q: %v", pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseTarget parses the URL of an upstream server
+func parseTarget(rawURL string) (*url.URL, error) {
+	if rawURL == "" {
+		return nil, errors.New("proxy: target URL is required")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: invalid target URL %q: %v", rawURL, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("proxy: target URL %q must be absolute", rawURL)
+	}
+
+	return u, nil
+}
+
+func (c *Config) maxIdleConns() int {
+	if c.MaxIdleConns == 0 {
+		return httpMaxIdleConns
+	}
+	return c.MaxIdleConns
+}
+
+func (c *Config) signatureHeader() string {
+	if c.SignatureHeader == "" {
+		return "X-Signature"
+	}
+	return c.SignatureHeader
+}
+
+// bufferMemoryBytes returns the most bytes of a buffered request body kept
+// in memory
+func (c *Config) bufferMemoryBytes() int64 {
+	if c.BufferMemoryBytes <= 0 {
+		return defaultBufferMemoryBytes
+	}
+	return c.BufferMemoryBytes
+}
+
+// captureSpillTTL returns how long a spilled capture is kept unread
+func (c *Config) captureSpillTTL() time.Duration {
+	if c.CaptureSpillTTL == 0 {
+		return defaultCaptureSpillTTL
+	}
+	return c.CaptureSpillTTL
+}
+
+// expectContinueTimeout returns how long to wait for the upstream to accept
+// a request body it was asked about
+func (c *Config) expectContinueTimeout() time.Duration {
+	if c.ExpectContinueTimeout == 0 {
+		return defaultExpectContinueTimeout
+	}
+	return c.ExpectContinueTimeout
+}
+
+// orDefault returns t, or the general Timeout when t is not set
+func (c *Config) orDefault(t time.Duration) time.Duration {
+	if t == 0 {
+		return c.Timeout
+	}
+	return t
+}
+
+// Option configures optional behaviour of the handler created by NewHandler
+type Option func(*Config)
+
+// WithMaxCaptureBytes sets Config.MaxCaptureBytes
+func WithMaxCaptureBytes(n int64) Option {
+	return func(c *Config) {
+		c.MaxCaptureBytes = n
+	}
+}
+
+// WithRetries sets Config.Retries
+func WithRetries(n int) Option {
+	return func(c *Config) {
+		c.Retries = n
+	}
+}
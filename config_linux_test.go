@@ -0,0 +1,66 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTransportKeepAlive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	cases := map[string]struct {
+		keepAlive time.Duration
+		// idle time before the first probe, zero when they are off
+		idle time.Duration
+	}{
+		"default":  {0, 15 * time.Second},
+		"interval": {time.Minute, time.Minute},
+		"disabled": {-1, 0},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			transport, err := proxy.NewTransport(proxy.Config{Timeout: timeout, KeepAlive: c.keepAlive})
+			require.NoError(t, err)
+
+			// the probes are set up by the dialer, on the connection itself
+			conn, err := transport.DialContext(context.Background(), "tcp", ln.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			raw, err := conn.(*net.TCPConn).SyscallConn()
+			require.NoError(t, err)
+
+			var enabled, idle int
+			var sockErr error
+			require.NoError(t, raw.Control(func(fd uintptr) {
+				if enabled, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); sockErr != nil {
+					return
+				}
+				idle, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+			}))
+			require.NoError(t, sockErr)
+
+			require.Equal(t, c.idle != 0, enabled != 0)
+			if c.idle != 0 {
+				require.Equal(t, c.idle, time.Duration(idle)*time.Second)
+			}
+		})
+	}
+}
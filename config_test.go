@@ -0,0 +1,176 @@
+package proxy_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvalidConfig(t *testing.T) {
+	cases := map[string]proxy.Config{
+		"empty URL":           {Timeout: timeout},
+		"relative URL":        {TargetURL: "/some/path", Timeout: timeout},
+		"unparsable URL":      {TargetURL: "http://[::1", Timeout: timeout},
+		"zero timeout":        {TargetURL: "http://localhost"},
+		"negative timeout":    {TargetURL: "http://localhost", Timeout: -timeout},
+		"negative idle pool":  {TargetURL: "http://localhost", Timeout: timeout, MaxIdleConns: -1},
+		"negative dial":       {TargetURL: "http://localhost", Timeout: timeout, DialTimeout: -timeout},
+		"negative request":    {TargetURL: "http://localhost", Timeout: timeout, RequestTimeout: -timeout},
+		"rate without burst":  {TargetURL: "http://localhost", Timeout: timeout, RateLimit: 1},
+		"socketless unix URL": {TargetURL: "unix://", Timeout: timeout},
+		"bad PROXY protocol":  {TargetURL: "http://localhost", Timeout: timeout, ProxyProtocol: 3},
+		"sample rate over 1":  {TargetURL: "http://localhost", Timeout: timeout, Sampling: true, SampleRate: 1.5},
+		"rate w/o sampling":   {TargetURL: "http://localhost", Timeout: timeout, SampleRate: 0.5},
+		"unknown log format":  {TargetURL: "http://localhost", Timeout: timeout, LogFormat: proxy.LogFormat(42)},
+		"bad path pattern":    {TargetURL: "http://localhost", Timeout: timeout, PathAllowlist: []string{"/api/["}},
+		"unknown strategy":    {Targets: []string{"http://localhost"}, Timeout: timeout, Strategy: proxy.Strategy(42)},
+		"relative public URL": {TargetURL: "http://localhost", Timeout: timeout, PublicURL: "/app"},
+	}
+
+	for name, cfg := range cases {
+		t.Run(name, func(t *testing.T) {
+			h, err := proxy.NewHandlerWithConfig(cfg)
+			require.Error(t, err)
+			require.Nil(t, h)
+		})
+	}
+}
+
+func TestHandlerWithConfig(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validateBody(t, r.Body, requestBody)
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	var status int
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:    target.URL,
+		Timeout:      timeout,
+		DataChan:     mchan,
+		Callback:     func(s int, err error) { status = s },
+		MaxIdleConns: 10,
+	})
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodPost, requestHeaders)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	validateBody(t, res.Body, responseBody)
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, mchan, 1)
+}
+
+// stubTransport responds to every request with a fixed body, never touching the network
+type stubTransport struct {
+	requests []*http.Request
+}
+
+func (s *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.requests = append(s.requests, req)
+	return &http.Response{
+		StatusCode: http.StatusTeapot,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       ioutil.NopCloser(strings.NewReader("stubbed")),
+		Request:    req,
+	}, nil
+}
+
+func TestCustomTransport(t *testing.T) {
+	stub := &stubTransport{}
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL: "http://upstream.invalid/base",
+		Timeout:   timeout,
+		Transport: stub,
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/some/path", nil))
+
+	require.Equal(t, http.StatusTeapot, w.Code)
+	require.Equal(t, "stubbed", w.Body.String())
+	require.Len(t, stub.requests, 1)
+	require.Equal(t, "http://upstream.invalid/base/some/path", stub.requests[0].URL.String())
+}
+
+// countingTransport counts the requests sent through the wrapped transport
+type countingTransport struct {
+	next  http.RoundTripper
+	count int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.count, 1)
+	return c.next.RoundTrip(req)
+}
+
+func TestNewTransport(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	cfg := proxy.Config{
+		TargetURL:       target.URL,
+		Timeout:         timeout,
+		KeepAlive:       time.Minute,
+		MaxIdleConns:    10,
+		IdleConnTimeout: 5 * time.Second,
+	}
+	transport, err := proxy.NewTransport(cfg)
+	require.NoError(t, err)
+	require.Equal(t, 10, transport.MaxIdleConns)
+	require.Equal(t, 10, transport.MaxIdleConnsPerHost)
+	require.Equal(t, 5*time.Second, transport.IdleConnTimeout)
+
+	// the transport wrapped, like for instrumentation, is injected back
+	counting := &countingTransport{next: transport}
+	cfg.Transport = counting
+	h, err := proxy.NewHandlerWithConfig(cfg)
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodGet, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	validateBody(t, res.Body, responseBody)
+	require.EqualValues(t, 1, atomic.LoadInt32(&counting.count))
+}
+
+func TestHTTP2Upstream(t *testing.T) {
+	var proto string
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	target.EnableHTTP2 = true
+	target.StartTLS()
+	defer target.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(target.Certificate())
+
+	for expected, enabled := range map[string]bool{"HTTP/2.0": true, "HTTP/1.1": false} {
+		h, err := proxy.NewHandlerWithConfig(proxy.Config{
+			TargetURL:   target.URL,
+			Timeout:     timeout,
+			TLSConfig:   &tls.Config{RootCAs: pool},
+			EnableHTTP2: enabled,
+		})
+		require.NoError(t, err)
+
+		res := doRequest(t, h, http.MethodPost, requestHeaders)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		validateBody(t, res.Body, responseBody)
+		require.Equal(t, expected, proto)
+	}
+}
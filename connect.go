@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTunnelNotAllowed is returned for CONNECT requests to destinations the
+// allow function of NewConnectHandler refuses
+var ErrTunnelNotAllowed = errors.New("proxy: tunnel destination not allowed")
+
+// NewConnectHandler creates http.HandlerFunc serving as a forward proxy for
+// HTTPS, separate from the reverse proxy handlers. A CONNECT request opens a
+// TCP connection to the host:port it names, then the client connection is
+// hijacked and bytes are spliced in both directions until either side
+// closes. Requests with other methods get 405.
+//
+// allow tells which destinations may be tunneled to, others get 403. It's
+// required, as the handler would otherwise relay to anything it can reach,
+// like loopback and internal services. timeout limits dialing the
+// destination. Data of a tunnel is published once it's closed, with Upgraded
+// set and the bytes counted, but nothing captured. Rejected requests are not
+// published
+func NewConnectHandler(allow func(hostport string) bool, timeout time.Duration, ch chan<- Data, cb func(status int, err error)) (http.HandlerFunc, error) {
+	if allow == nil {
+		return nil, errors.New("proxy: allow function is required")
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("proxy: timeout must be positive, got %s", timeout)
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var d Data
+		d.Times.Start = time.Now()
+		d.RequestID = newRequestID()
+		d.RequestHeader = r.Header.Clone()
+		d.Error = tunnel(dialer, w, &d, r, allow)
+		d.Times.End = time.Now()
+		d.ErrorKind = classifyError(d.Error, d.StatusCode)
+
+		var rej *rejection
+		rejected := errors.As(d.Error, &rej)
+		if rejected {
+			d.StatusCode = rej.status
+		}
+
+		if cb != nil {
+			cb(d.StatusCode, d.Error)
+		}
+		if !rejected && ch != nil {
+			select {
+			case ch <- d:
+			default:
+				atomic.AddUint64(&dropped, 1)
+			}
+		}
+
+		// the connection of an established tunnel is not ours to write to anymore
+		if d.Error != nil && !d.Upgraded {
+			http.Error(w, http.StatusText(d.StatusCode), d.StatusCode)
+		}
+	}, nil
+}
+
+// tunnel dials the destination of the CONNECT request r and splices the
+// client connection to it
+func tunnel(dialer *net.Dialer, w http.ResponseWriter, d *Data, r *http.Request, allow func(string) bool) error {
+	if r.Method != http.MethodConnect {
+		w.Header().Set("Allow", http.MethodConnect)
+		return &rejection{status: http.StatusMethodNotAllowed, err: ErrMethodNotAllowed}
+	}
+	// the request target of CONNECT is the authority, which ends up in Host
+	if _, port, err := net.SplitHostPort(r.Host); err != nil || port == "" {
+		return &rejection{status: http.StatusBadRequest, err: fmt.Errorf("proxy: CONNECT target %q is not host:port", r.Host)}
+	}
+	if !allow(r.Host) {
+		return &rejection{status: http.StatusForbidden, err: ErrTunnelNotAllowed}
+	}
+	d.Upstream = r.Host
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		d.StatusCode = http.StatusInternalServerError
+		return errors.New("proxy: response writer does not support hijacking")
+	}
+
+	d.Times.ConnectStart = time.Now()
+	backConn, err := dialer.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		d.StatusCode = failureStatus(r, err)
+		return err
+	}
+	d.Times.ConnectDone = time.Now()
+	defer backConn.Close()
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		d.StatusCode = http.StatusInternalServerError
+		return err
+	}
+	defer conn.Close()
+	d.StatusCode = http.StatusOK
+	d.Upgraded = true
+
+	if _, err := brw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return err
+	}
+	if err := brw.Flush(); err != nil {
+		return err
+	}
+
+	// the client reader may hold bytes already sent after the request head
+	done := make(chan struct{}, 2)
+	go func() {
+		d.RequestBytes, _ = io.Copy(backConn, brw.Reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		d.ResponseBytes, _ = io.Copy(conn, backConn)
+		done <- struct{}{}
+	}()
+
+	// whichever side closes first tears down the other, then both counts are final
+	<-done
+	conn.Close()
+	backConn.Close()
+	<-done
+	return nil
+}
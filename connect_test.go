@@ -0,0 +1,110 @@
+package proxy_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectHandler(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validateBody(t, r.Body, requestBody)
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	defer target.Close()
+	targetHost := strings.TrimPrefix(target.URL, "https://")
+
+	mchan := make(chan proxy.Data, 1)
+	h, err := proxy.NewConnectHandler(func(hostport string) bool {
+		return hostport == targetHost
+	}, timeout, mchan, nil)
+	require.NoError(t, err)
+	prx := httptest.NewServer(h)
+	defer prx.Close()
+
+	proxyURL, err := url.Parse(prx.URL)
+	require.NoError(t, err)
+	transport := target.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	client := &http.Client{Transport: transport}
+
+	// the TLS handshake with the target goes through the tunnel
+	res, err := client.Post(target.URL, "text/xml", strings.NewReader(requestBody))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	validateBody(t, res.Body, responseBody)
+	require.NotNil(t, res.TLS)
+	transport.CloseIdleConnections()
+
+	data := <-mchan
+	require.NoError(t, data.Error)
+	require.Equal(t, http.StatusOK, data.StatusCode)
+	require.True(t, data.Upgraded)
+	require.Equal(t, targetHost, data.Upstream)
+	require.Nil(t, data.Request)
+	require.Nil(t, data.Response)
+	require.Greater(t, data.RequestBytes, int64(len(requestBody)))
+	require.Greater(t, data.ResponseBytes, int64(len(responseBody)))
+}
+
+func TestConnectHandlerRejects(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	refused := l.Addr().String()
+	l.Close()
+
+	mchan := make(chan proxy.Data, 1)
+	h, err := proxy.NewConnectHandler(func(hostport string) bool {
+		return strings.HasSuffix(hostport, ":443") || hostport == refused
+	}, timeout, mchan, nil)
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		method, target string
+		status         int
+	}{
+		"not CONNECT":  {http.MethodGet, "http://example.com/", http.StatusMethodNotAllowed},
+		"not allowed":  {http.MethodConnect, "example.com:22", http.StatusForbidden},
+		"missing port": {http.MethodConnect, "example.com", http.StatusBadRequest},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, "http://proxy/", nil)
+			req.Host = c.target
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			require.Equal(t, c.status, rec.Code)
+		})
+	}
+
+	require.Len(t, mchan, 0, "rejected requests must not be published")
+
+	// a destination that can't be reached is not a rejection
+	prx := httptest.NewServer(h)
+	defer prx.Close()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(prx.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "CONNECT "+refused+" HTTP/1.1\r\nHost: "+refused+"\r\n\r\n")
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadGateway, res.StatusCode)
+
+	data := <-mchan
+	require.Error(t, data.Error)
+	require.False(t, data.Upgraded)
+
+	_, err = proxy.NewConnectHandler(func(string) bool { return true }, 0, nil, nil)
+	require.Error(t, err)
+	_, err = proxy.NewConnectHandler(nil, timeout, nil, nil)
+	require.Error(t, err, "an open relay must be asked for explicitly")
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS configures answering cross-origin requests of browsers
+type CORS struct {
+	// AllowedOrigins may make cross-origin requests, "*" allows any origin
+	AllowedOrigins []string
+	// AllowedMethods of cross-origin requests, GET, HEAD and POST by default
+	AllowedMethods []string
+	// AllowedHeaders clients may send with cross-origin requests
+	AllowedHeaders []string
+	// MaxAge is how long browsers may cache preflight responses
+	MaxAge time.Duration
+}
+
+// preflight reports whether r is a CORS preflight request
+func preflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// answerPreflight responds to the preflight request r on its own. Disallowed
+// origins get no Access-Control headers, so that the browser refuses the
+// actual request
+func (c *CORS) answerPreflight(w http.ResponseWriter, r *http.Request) {
+	if c.allowOrigin(w.Header(), r.Header.Get("Origin")) {
+		methods := c.AllowedMethods
+		if len(methods) == 0 {
+			methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if len(c.AllowedHeaders) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		}
+		if c.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowOrigin sets Access-Control-Allow-Origin in h, if origin is allowed
+func (c *CORS) allowOrigin(h http.Header, origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, o := range c.AllowedOrigins {
+		switch o {
+		case "*":
+			h.Set("Access-Control-Allow-Origin", "*")
+			return true
+		case origin:
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Add("Vary", "Origin")
+			return true
+		}
+	}
+	return false
+}
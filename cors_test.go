@@ -0,0 +1,76 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCORS(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	var calls int
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		// the header of the proxy replaces the upstream one
+		w.Header().Set("Access-Control-Allow-Origin", "https://upstream.example.com")
+		writeResponse(w, responseBody, nil)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL: target.URL,
+		Timeout:   timeout,
+		DataChan:  mchan,
+		CORS: &proxy.CORS{
+			AllowedOrigins: []string{"https://app.example.com"},
+			AllowedMethods: []string{http.MethodGet, http.MethodPut},
+			AllowedHeaders: []string{"Content-Type", "Authorization"},
+			MaxAge:         10 * time.Minute,
+		},
+	})
+	require.NoError(t, err)
+
+	send := func(method, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/", nil)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+
+	t.Run("preflight", func(t *testing.T) {
+		w := send(http.MethodOptions, "https://app.example.com")
+		require.Equal(t, http.StatusNoContent, w.Code)
+		require.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		require.Equal(t, "GET, PUT", w.Header().Get("Access-Control-Allow-Methods"))
+		require.Equal(t, "Content-Type, Authorization", w.Header().Get("Access-Control-Allow-Headers"))
+		require.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+		require.Zero(t, calls, "preflight requests must not be proxied")
+		require.Len(t, mchan, 0)
+	})
+
+	t.Run("disallowed preflight", func(t *testing.T) {
+		w := send(http.MethodOptions, "https://evil.example.com")
+		require.Equal(t, http.StatusNoContent, w.Code)
+		require.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+		require.Empty(t, w.Header().Get("Access-Control-Allow-Methods"))
+		require.Zero(t, calls)
+	})
+
+	t.Run("actual request", func(t *testing.T) {
+		w := send(http.MethodGet, "https://app.example.com")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, []string{"https://app.example.com"}, w.Header().Values("Access-Control-Allow-Origin"))
+		require.Equal(t, "Origin", w.Header().Get("Vary"))
+		require.Equal(t, 1, calls)
+		require.Len(t, mchan, 1)
+	})
+}
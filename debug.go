@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// replaces secrets in the document of NewDebugHandler
+const redacted = "[redacted]"
+
+// debugDocument is the JSON document served by NewDebugHandler
+type debugDocument struct {
+	Config    debugConfig     `json:"config"`
+	Stats     debugStats      `json:"stats"`
+	Ready     bool            `json:"ready"`
+	Upstreams []debugUpstream `json:"upstreams"`
+}
+
+// debugConfig is the part of Config worth showing, without secrets
+type debugConfig struct {
+	TargetURL             string            `json:"target_url,omitempty"`
+	Targets               []string          `json:"targets,omitempty"`
+	Weights               []int             `json:"weights,omitempty"`
+	Strategy              Strategy          `json:"strategy,omitempty"`
+	Timeout               string            `json:"timeout"`
+	DialTimeout           string            `json:"dial_timeout,omitempty"`
+	ResponseHeaderTimeout string            `json:"response_header_timeout,omitempty"`
+	RequestTimeout        string            `json:"request_timeout,omitempty"`
+	IdleConnTimeout       string            `json:"idle_conn_timeout,omitempty"`
+	KeepAlive             string            `json:"keep_alive,omitempty"`
+	MaxIdleConns          int               `json:"max_idle_conns,omitempty"`
+	MaxConcurrent         int               `json:"max_concurrent,omitempty"`
+	Retries               int               `json:"retries,omitempty"`
+	RateLimit             float64           `json:"rate_limit,omitempty"`
+	RateBurst             int               `json:"rate_burst,omitempty"`
+	CaptureRequest        bool              `json:"capture_request"`
+	CaptureResponse       bool              `json:"capture_response"`
+	MaxCaptureBytes       int64             `json:"max_capture_bytes,omitempty"`
+	Sampling              bool              `json:"sampling,omitempty"`
+	SampleRate            float64           `json:"sample_rate,omitempty"`
+	MaxRequestBodyBytes   int64             `json:"max_request_body_bytes,omitempty"`
+	MaxResponseBodyBytes  int64             `json:"max_response_body_bytes,omitempty"`
+	CacheMaxEntries       int               `json:"cache_max_entries,omitempty"`
+	EjectAfter            int               `json:"eject_after,omitempty"`
+	EjectCooldown         string            `json:"eject_cooldown,omitempty"`
+	AllowedMethods        []string          `json:"allowed_methods,omitempty"`
+	PathAllowlist         []string          `json:"path_allowlist,omitempty"`
+	StripPrefix           string            `json:"strip_prefix,omitempty"`
+	AddPrefix             string            `json:"add_prefix,omitempty"`
+	PreserveHost          bool              `json:"preserve_host"`
+	SetRequestHeaders     map[string]string `json:"set_request_headers,omitempty"`
+	ClientCertFile        string            `json:"client_cert_file,omitempty"`
+	ClientKeyFile         string            `json:"client_key_file,omitempty"`
+	CAFile                string            `json:"ca_file,omitempty"`
+	InsecureSkipVerify    bool              `json:"insecure_skip_verify"`
+	SigningSecret         string            `json:"signing_secret,omitempty"`
+}
+
+type debugStats struct {
+	InFlight int64          `json:"in_flight"`
+	Total    uint64         `json:"total"`
+	Dropped  uint64         `json:"dropped"`
+	Statuses map[int]uint64 `json:"statuses"`
+}
+
+type debugUpstream struct {
+	Name         string     `json:"name"`
+	Healthy      bool       `json:"healthy"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	Failures     int        `json:"failures"`
+	InFlight     int64      `json:"in_flight"`
+}
+
+// NewDebugHandler creates http.HandlerFunc serving a JSON document with the
+// configuration of p, its Stats, readiness, and the health of its upstreams.
+// It's meant to be mounted apart from p, like on an admin port. Secrets,
+// like the client key file, the signing secret, credentials in target URLs
+// and the values of SetRequestHeaders, are redacted
+func NewDebugHandler(p *Proxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		stats := p.Stats()
+		doc := debugDocument{
+			Config: newDebugConfig(&p.cfg),
+			Stats: debugStats{
+				InFlight: stats.InFlight,
+				Total:    stats.Total,
+				Dropped:  stats.Dropped,
+				Statuses: stats.Statuses,
+			},
+			Ready:     p.Ready(),
+			Upstreams: []debugUpstream{},
+		}
+		for _, u := range p.counters.upstreams {
+			doc.Upstreams = append(doc.Upstreams, u.debug(now))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(doc)
+	}
+}
+
+func newDebugConfig(cfg *Config) debugConfig {
+	dc := debugConfig{
+		TargetURL:             redactURL(cfg.TargetURL),
+		Strategy:              cfg.Strategy,
+		Timeout:               cfg.Timeout.String(),
+		DialTimeout:           durationString(cfg.DialTimeout),
+		ResponseHeaderTimeout: durationString(cfg.ResponseHeaderTimeout),
+		RequestTimeout:        durationString(cfg.RequestTimeout),
+		IdleConnTimeout:       durationString(cfg.IdleConnTimeout),
+		KeepAlive:             durationString(cfg.KeepAlive),
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxConcurrent:         cfg.MaxConcurrent,
+		Retries:               cfg.Retries,
+		RateLimit:             float64(cfg.RateLimit),
+		RateBurst:             cfg.RateBurst,
+		CaptureRequest:        cfg.CaptureRequest,
+		CaptureResponse:       cfg.CaptureResponse,
+		MaxCaptureBytes:       cfg.MaxCaptureBytes,
+		Sampling:              cfg.Sampling,
+		SampleRate:            cfg.SampleRate,
+		MaxRequestBodyBytes:   cfg.MaxRequestBodyBytes,
+		MaxResponseBodyBytes:  cfg.MaxResponseBodyBytes,
+		CacheMaxEntries:       cfg.CacheMaxEntries,
+		EjectAfter:            cfg.EjectAfter,
+		EjectCooldown:         durationString(cfg.EjectCooldown),
+		AllowedMethods:        cfg.AllowedMethods,
+		PathAllowlist:         cfg.PathAllowlist,
+		StripPrefix:           cfg.StripPrefix,
+		AddPrefix:             cfg.AddPrefix,
+		PreserveHost:          cfg.PreserveHost,
+		ClientCertFile:        cfg.ClientCertFile,
+		CAFile:                cfg.CAFile,
+		InsecureSkipVerify:    cfg.InsecureSkipVerify,
+	}
+	for _, t := range cfg.Targets {
+		dc.Targets = append(dc.Targets, redactURL(t))
+	}
+	for _, t := range cfg.WeightedTargets {
+		dc.Targets = append(dc.Targets, redactURL(t.URL))
+		dc.Weights = append(dc.Weights, t.Weight)
+	}
+	if len(cfg.SetRequestHeaders) > 0 {
+		// header values may be credentials, like an Authorization header
+		dc.SetRequestHeaders = make(map[string]string, len(cfg.SetRequestHeaders))
+		for name := range cfg.SetRequestHeaders {
+			dc.SetRequestHeaders[name] = redacted
+		}
+	}
+	if cfg.ClientKeyFile != "" {
+		dc.ClientKeyFile = redacted
+	}
+	if cfg.SigningSecret != nil {
+		dc.SigningSecret = redacted
+	}
+	return dc
+}
+
+// debug returns a snapshot of the health of the upstream
+func (u *upstream) debug(now time.Time) debugUpstream {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	du := debugUpstream{
+		Name:     u.name(),
+		Healthy:  !now.Before(u.ejectedUntil),
+		Failures: u.failures,
+		InFlight: atomic.LoadInt64(&u.inFlight),
+	}
+	if !du.Healthy {
+		until := u.ejectedUntil
+		du.EjectedUntil = &until
+	}
+	return du
+}
+
+// redactURL hides the password of a URL with credentials
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// most upstreams a resolver keeps, the least recently used are dropped
+const maxResolvedUpstreams = 1024
+
+// resolver is a balancer asking resolve for the upstream of every request.
+// Upstreams are kept by URL, so that hot targets are parsed once. As targets
+// may come from the request, only the most recently used are kept
+type resolver struct {
+	resolve func(*http.Request) (string, error)
+
+	mu        sync.Mutex
+	upstreams map[string]*list.Element
+	// least recently used first
+	order *list.List
+}
+
+func newResolver(resolve func(*http.Request) (string, error)) *resolver {
+	return &resolver{resolve: resolve, upstreams: make(map[string]*list.Element), order: list.New()}
+}
+
+func (res *resolver) pick(r *http.Request) (*upstream, error) {
+	target, err := res.resolve(r)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, ErrNoRoute) {
+			status = http.StatusNotFound
+		}
+		return nil, &rejection{status: status, err: fmt.Errorf("proxy: resolve upstream: %w", err)}
+	}
+	if u := res.lookup(target); u != nil {
+		return u, nil
+	}
+
+	u, err := newUpstream(target)
+	if err != nil {
+		return nil, &rejection{status: http.StatusBadGateway, err: err}
+	}
+	return res.store(target, u), nil
+}
+
+// lookup returns the upstream kept for target, if any
+func (res *resolver) lookup(target string) *upstream {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	el, ok := res.upstreams[target]
+	if !ok {
+		return nil
+	}
+	res.order.MoveToBack(el)
+	return el.Value.(*resolvedUpstream).upstream
+}
+
+// store keeps u for target, unless another request did first, and returns
+// the upstream kept
+func (res *resolver) store(target string, u *upstream) *upstream {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	if el, ok := res.upstreams[target]; ok {
+		res.order.MoveToBack(el)
+		return el.Value.(*resolvedUpstream).upstream
+	}
+	res.upstreams[target] = res.order.PushBack(&resolvedUpstream{target: target, upstream: u})
+	for res.order.Len() > maxResolvedUpstreams {
+		oldest := res.order.Front()
+		res.order.Remove(oldest)
+		delete(res.upstreams, oldest.Value.(*resolvedUpstream).target)
+	}
+	return u
+}
+
+// resolvedUpstream is an upstream kept by a resolver
+type resolvedUpstream struct {
+	target   string
+	upstream *upstream
+}
+
+// NewDynamicHandler creates http.HandlerFunc proxying every request to the
+// upstream URL resolve returns for it, e.g. based on its Host header. Requests
+// resolve fails for get 502, or 404 when it fails with ErrNoRoute, without
+// publishing Data. The upstreams of the 1024 targets resolved last are kept,
+// others are set up again when resolved once more. Apart from that, it
+// behaves like the handler created by NewHandler
+func NewDynamicHandler(resolve func(*http.Request) (string, error), timeout time.Duration, ch chan<- Data, cb func(status int, err error)) (http.HandlerFunc, error) {
+	if resolve == nil {
+		return nil, errors.New("proxy: resolve function is required")
+	}
+
+	cfg := Config{
+		Timeout:         timeout,
+		DataChan:        ch,
+		Callback:        cb,
+		CaptureRequest:  true,
+		CaptureResponse: true,
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return newHandler(cfg, newResolver(resolve), &counters{}), nil
+}
@@ -0,0 +1,74 @@
+package proxy_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDynamicHandler(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	first := newNamedServer("first")
+	defer first.Close()
+	second := newNamedServer("second")
+	defer second.Close()
+
+	backends := map[string]string{
+		"first.example.com":  first.URL,
+		"second.example.com": second.URL,
+		"broken.example.com": "not a URL",
+	}
+	h, err := proxy.NewDynamicHandler(func(r *http.Request) (string, error) {
+		if target, ok := backends[r.Host]; ok {
+			return target, nil
+		}
+		return "", errors.New("unknown host")
+	}, timeout, mchan, nil)
+	require.NoError(t, err)
+
+	for _, name := range []string{"first", "second", "first"} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "http://"+name+".example.com/", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, name, w.Body.String())
+
+		data := <-mchan
+		expected := first
+		if name == "second" {
+			expected = second
+		}
+		require.Equal(t, expected.Listener.Addr().String(), data.Upstream)
+	}
+
+	for _, host := range []string{"unknown.example.com", "broken.example.com"} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		require.Equal(t, http.StatusBadGateway, w.Code)
+		require.Len(t, mchan, 0, "unresolved requests must not be published")
+	}
+}
+
+func TestDynamicHandlerManyTargets(t *testing.T) {
+	target := newNamedServer("target")
+	defer target.Close()
+
+	// targets taken from the request are as many as clients make up, those
+	// dropped to bound them are set up again when resolved once more
+	h, err := proxy.NewDynamicHandler(func(r *http.Request) (string, error) {
+		return target.URL + "/" + r.Host, nil
+	}, timeout, nil, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 1500; i++ {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://%d.example.com/", i%1100), nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "target", w.Body.String())
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// decodeBody decompresses body sent with the given Content-Encoding. A body
+// cut short (e.g. a truncated capture) is decoded as far as it goes. ok is
+// false when the encoding is not supported or the body can't be decoded at all
+func decodeBody(encoding string, body []byte) (decoded []byte, ok bool) {
+	var r io.Reader
+	var err error
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// deflate is meant to be zlib-wrapped, but some servers send raw deflate
+		r, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			r, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return nil, false
+	}
+	if err != nil {
+		return nil, false
+	}
+
+	decoded, err = io.ReadAll(r)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, false
+	}
+
+	return decoded, true
+}
+
+// compressible reports whether res may be gzipped on its way to a client that
+// sent the request headers h: the client accepts gzip, and res is an
+// uncompressed text-like body. Parts of a body aren't, the ranges are of the
+// uncompressed bytes
+func compressible(res *http.Response, h http.Header) bool {
+	if res.Header.Get("Content-Encoding") != "" || res.ContentLength == 0 || !acceptsGzip(h) {
+		return false
+	}
+	if res.StatusCode == http.StatusPartialContent || res.Header.Get("Content-Range") != "" {
+		return false
+	}
+	if bodyless(res) {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "text/event-stream":
+		// events must reach the client one by one
+		return false
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// weakETag returns the ETag etag turns into once the body is compressed: the
+// bytes differ, so a strong one only holds as weak
+func weakETag(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return "W/" + etag
+}
+
+// acceptsGzip reports whether the Accept-Encoding values of h allow gzip
+func acceptsGzip(h http.Header) bool {
+	// gzip's own q-value wins over the one of *, wherever either is listed
+	gzipQ, anyQ := -1.0, -1.0
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			q := 1.0
+			if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				q, _ = strconv.ParseFloat(value, 64)
+			}
+			if name == "gzip" {
+				gzipQ = q
+			} else {
+				anyQ = q
+			}
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
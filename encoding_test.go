@@ -0,0 +1,159 @@
+package proxy_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipBytes(t *testing.T, s string) []byte {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write([]byte(s))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	return buf.Bytes()
+}
+
+func TestDecodeCapturedBody(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+	plain := "<xml>compressed response</xml>"
+	compressed := gzipBytes(t, plain)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:          target.URL,
+		Timeout:            timeout,
+		DataChan:           mchan,
+		CaptureResponse:    true,
+		DecodeCapturedBody: true,
+	})
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodGet, map[string]string{"Accept-Encoding": "gzip"})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, compressed, body, "client must get the compressed bytes")
+
+	data := <-mchan
+	captured, err := ioutil.ReadAll(data.Response)
+	require.NoError(t, err)
+	require.Equal(t, plain, string(captured))
+	require.Equal(t, int64(len(compressed)), data.ResponseBytes)
+}
+
+func TestCompressResponses(t *testing.T) {
+	const body = `{"message": "hello, hello, hello"}`
+	gzipped := gzipBytes(t, body)
+
+	cases := map[string]struct {
+		encoding       string
+		upstreamBody   []byte
+		acceptEncoding string
+		compressed     bool
+	}{
+		"uncompressed":       {"", []byte(body), "gzip, deflate", true},
+		"already gzipped":    {"gzip", gzipped, "gzip", false},
+		"gzip not accepted":  {"", []byte(body), "gzip;q=0, deflate", false},
+		"gzip refused by q":  {"", []byte(body), "*;q=1, gzip;q=0", false},
+		"any accepted":       {"", []byte(body), "deflate, *;q=0.5", true},
+		"no accept encoding": {"", []byte(body), "", false},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			mchan := make(chan proxy.Data, 1)
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("ETag", `"v1"`)
+				if c.encoding != "" {
+					w.Header().Set("Content-Encoding", c.encoding)
+				}
+				w.Write(c.upstreamBody)
+			}))
+			defer target.Close()
+
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL:         target.URL,
+				Timeout:           timeout,
+				DataChan:          mchan,
+				CaptureResponse:   true,
+				CompressResponses: true,
+			})
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if c.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", c.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			h(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			if !c.compressed {
+				require.Equal(t, c.encoding, w.Header().Get("Content-Encoding"))
+				require.Equal(t, c.upstreamBody, w.Body.Bytes(), "the body must be passed on as is")
+				require.Equal(t, `"v1"`, w.Header().Get("ETag"))
+				return
+			}
+			require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+			require.Equal(t, `W/"v1"`, w.Header().Get("ETag"), "the compressed bytes differ")
+			require.Empty(t, w.Header().Get("Content-Length"))
+			zr, err := gzip.NewReader(w.Body)
+			require.NoError(t, err)
+			decoded, err := ioutil.ReadAll(zr)
+			require.NoError(t, err)
+			require.Equal(t, body, string(decoded))
+
+			// the capture is of the uncompressed body
+			captured, err := ioutil.ReadAll((<-mchan).Response)
+			require.NoError(t, err)
+			require.Equal(t, body, string(captured))
+		})
+	}
+}
+
+func TestCompressResponsesPartial(t *testing.T) {
+	const body = `{"message": "hello, hello, hello"}`
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/100", len(body)-1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(body))
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:         target.URL,
+		Timeout:           timeout,
+		CompressResponses: true,
+	})
+	require.NoError(t, err)
+
+	// the range is of the uncompressed bytes, the part is passed on as is
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-")
+	w := httptest.NewRecorder()
+	h(w, req)
+	require.Equal(t, http.StatusPartialContent, w.Code)
+	require.Empty(t, w.Header().Get("Content-Encoding"))
+	require.Equal(t, fmt.Sprintf("bytes 0-%d/100", len(body)-1), w.Header().Get("Content-Range"))
+	require.Equal(t, body, w.Body.String())
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ErrorKind is a category of failures of proxied requests
+type ErrorKind int
+
+const (
+	// ErrNone is the kind of successful requests
+	ErrNone ErrorKind = iota
+	// ErrTimeout is the upstream not connecting or responding in time
+	ErrTimeout
+	// ErrDial is a failure to reach the upstream, like a DNS lookup failure or
+	// a refused connection
+	ErrDial
+	// ErrTLS is a failed TLS handshake, like an untrusted upstream certificate
+	ErrTLS
+	// ErrUpstream5xx is the upstream responding with a server error status
+	ErrUpstream5xx
+	// ErrOther is any other failure, like a request refused by the proxy itself
+	ErrOther
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrNone:
+		return "none"
+	case ErrTimeout:
+		return "timeout"
+	case ErrDial:
+		return "dial"
+	case ErrTLS:
+		return "tls"
+	case ErrUpstream5xx:
+		return "upstream_5xx"
+	default:
+		return "other"
+	}
+}
+
+// classifyError finds the kind of err, the outcome of a request the upstream
+// answered with status when err is nil
+func classifyError(err error, status int) ErrorKind {
+	if err == nil {
+		if status >= http.StatusInternalServerError {
+			return ErrUpstream5xx
+		}
+		return ErrNone
+	}
+
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout() {
+		return ErrTimeout
+	}
+
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	if errors.As(err, &verifyErr) || errors.As(err, &recordErr) || errors.As(err, &alertErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return ErrTLS
+	}
+
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	if errors.As(err, &dnsErr) || errors.As(err, &opErr) && opErr.Op == "dial" {
+		return ErrDial
+	}
+	return ErrOther
+}
+
+// failureStatus is the status of req, which the upstream failed to answer
+// with err: 504 on timeouts, including Config.RequestTimeout running out,
+// and 502 on any other failure, like a refused connection
+func failureStatus(req *http.Request, err error) int {
+	if classifyError(err, 0) == ErrTimeout || errors.Is(req.Context().Err(), context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
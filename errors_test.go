@@ -0,0 +1,67 @@
+package proxy_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorKind(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+
+	// the certificate of the TLS server is not trusted by the proxy
+	untrusted := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer untrusted.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	refused := "http://" + l.Addr().String()
+	l.Close()
+
+	for _, tc := range []struct {
+		target string
+		kind   proxy.ErrorKind
+		status int
+	}{
+		{ok.URL, proxy.ErrNone, http.StatusOK},
+		{slow.URL, proxy.ErrTimeout, http.StatusGatewayTimeout},
+		{refused, proxy.ErrDial, http.StatusBadGateway},
+		{"http://nonexistent.invalid", proxy.ErrDial, http.StatusBadGateway},
+		{untrusted.URL, proxy.ErrTLS, http.StatusBadGateway},
+		{failing.URL, proxy.ErrUpstream5xx, http.StatusInternalServerError},
+	} {
+		t.Run(tc.kind.String(), func(t *testing.T) {
+			mchan := make(chan proxy.Data, 1)
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL: tc.target,
+				Timeout:   100 * time.Millisecond,
+				DataChan:  mchan,
+			})
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			require.Equal(t, tc.status, w.Code)
+
+			data := <-mchan
+			require.Equal(t, tc.kind, data.ErrorKind, "error: %v", data.Error)
+			require.Equal(t, tc.status, data.StatusCode)
+		})
+	}
+}
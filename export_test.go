@@ -0,0 +1,4 @@
+package proxy
+
+// CopyHeaders exposes copyHeaders to the benchmarks
+var CopyHeaders = copyHeaders
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// FallbackResponse is sent to clients instead of the error response when no
+// upstream can be reached, see Config.Fallback
+type FallbackResponse struct {
+	// StatusCode of the response, 503 when zero
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Func, when not nil, makes the response for the failed request instead
+	// of the fields above, like the last good one kept by the caller.
+	// Returning nil, or a response with an invalid status, sends the usual
+	// error response
+	Func func(r *http.Request, err error) *FallbackResponse
+}
+
+// response returns the fallback to send for r failing with err, if any
+func (f *FallbackResponse) response(r *http.Request, err error) *FallbackResponse {
+	if f.Func == nil {
+		return f
+	}
+	// the status of a made response is only known now
+	if res := f.Func(r, err); res != nil && res.validate() == nil {
+		return res
+	}
+	return nil
+}
+
+func (f *FallbackResponse) status() int {
+	if f.StatusCode == 0 {
+		return http.StatusServiceUnavailable
+	}
+	return f.StatusCode
+}
+
+func (f *FallbackResponse) validate() error {
+	if f.StatusCode != 0 && (f.StatusCode < 100 || f.StatusCode > 999) {
+		return fmt.Errorf("proxy: invalid fallback status %d", f.StatusCode)
+	}
+	return nil
+}
+
+func (f *FallbackResponse) write(w http.ResponseWriter) {
+	copyHeaders(w.Header(), f.Header)
+	w.Header().Set("Content-Length", strconv.Itoa(len(f.Body)))
+	w.WriteHeader(f.status())
+	w.Write(f.Body)
+}
+
+// unreachable reports whether the request failed at the connection level,
+// before any upstream could answer it
+func unreachable(d *Data) bool {
+	return d.ErrorKind == ErrDial || d.ErrorKind == ErrTLS || errors.Is(d.Error, ErrNoHealthyUpstream)
+}
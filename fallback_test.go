@@ -0,0 +1,112 @@
+package proxy_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	refused := "http://" + l.Addr().String()
+	l.Close()
+
+	t.Run("static", func(t *testing.T) {
+		mchan := make(chan proxy.Data, 1)
+		h, err := proxy.NewHandlerWithConfig(proxy.Config{
+			TargetURL: refused,
+			Timeout:   timeout,
+			DataChan:  mchan,
+			Fallback: &proxy.FallbackResponse{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": {"text/html"}},
+				Body:       []byte("<h1>Down for maintenance</h1>"),
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				t.Error("the fallback must take precedence")
+			},
+		})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "text/html", w.Header().Get("Content-Type"))
+		require.Equal(t, "<h1>Down for maintenance</h1>", w.Body.String())
+
+		data := <-mchan
+		require.Error(t, data.Error, "the failure must still be published")
+		require.Equal(t, proxy.ErrDial, data.ErrorKind)
+		require.Equal(t, http.StatusBadGateway, data.StatusCode)
+		require.Equal(t, http.StatusOK, data.ClientStatusCode)
+	})
+
+	t.Run("func", func(t *testing.T) {
+		var failure error
+		h, err := proxy.NewHandlerWithConfig(proxy.Config{
+			TargetURL: refused,
+			Timeout:   timeout,
+			Fallback: &proxy.FallbackResponse{
+				Func: func(r *http.Request, err error) *proxy.FallbackResponse {
+					failure = err
+					switch r.URL.Path {
+					case "/cached":
+						return &proxy.FallbackResponse{Body: []byte("last good")}
+					case "/broken":
+						return &proxy.FallbackResponse{StatusCode: 42, Body: []byte("broken")}
+					}
+					return nil
+				},
+			},
+		})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/cached", nil))
+		require.Error(t, failure)
+		require.Equal(t, http.StatusServiceUnavailable, w.Code)
+		require.Equal(t, "last good", w.Body.String())
+
+		// no response, or one that can't be sent, gets the usual error
+		for _, path := range []string{"/other", "/broken"} {
+			w = httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodGet, path, nil))
+			require.Equal(t, http.StatusBadGateway, w.Code, path)
+			require.Equal(t, "Bad Gateway\n", w.Body.String(), path)
+		}
+	})
+
+	t.Run("upstream error", func(t *testing.T) {
+		// only failures to reach the upstream fall back, not its own errors
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer target.Close()
+
+		h, err := proxy.NewHandlerWithConfig(proxy.Config{
+			TargetURL: target.URL,
+			Timeout:   timeout,
+			Fallback:  &proxy.FallbackResponse{Body: []byte("fallback")},
+		})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+		require.Empty(t, w.Body.String())
+	})
+
+	t.Run("invalid status", func(t *testing.T) {
+		_, err := proxy.NewHandlerWithConfig(proxy.Config{
+			TargetURL: refused,
+			Timeout:   timeout,
+			Fallback:  &proxy.FallbackResponse{StatusCode: 42},
+		})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// NewHealthHandler creates http.HandlerFunc that probes the upstream at the given
+// URL with a HEAD request. It responds with 200 when the upstream answers within
+// timeout, and with 503 otherwise. Any HTTP response counts as an answer, as it
+// proves the upstream is reachable. Nothing is published to the Data channel
+func NewHealthHandler(targetURL string, timeout time.Duration) (http.HandlerFunc, error) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, err
+	}
+	transport := newTransport(&Config{Timeout: timeout})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		latency, err := probe(r.Context(), transport, u, timeout)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("upstream unavailable: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprintf(w, "upstream latency: %s\n", latency)
+	}, nil
+}
+
+// probe sends a HEAD request to u and measures how long it takes to get a response
+func probe(ctx context.Context, transport http.RoundTripper, u *url.URL, timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	res, err := transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	return time.Since(start), nil
+}
@@ -0,0 +1,60 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func checkHealth(t *testing.T, target *httptest.Server) *http.Response {
+	h, err := proxy.NewHealthHandler(target.URL, timeout)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	return w.Result()
+}
+
+func TestHealthyUpstream(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodHead, r.Method)
+	}))
+	defer target.Close()
+
+	res := checkHealth(t, target)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "upstream latency:")
+}
+
+func TestTimedOutUpstream(t *testing.T) {
+	stop := make(chan bool)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-stop:
+		case <-time.After(2 * timeout):
+		}
+	}))
+	defer target.Close()
+	defer close(stop)
+
+	res := checkHealth(t, target)
+	require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+}
+
+func TestUnreachableUpstream(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	target.Close()
+
+	res := checkHealth(t, target)
+	require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+}
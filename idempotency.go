@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// header of requests to deduplicate, see Config.IdempotencyTTL
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// most idempotency keys remembered, the least recently used are forgotten first
+const idempotencyMaxEntries = 4096
+
+// idempotencyCache keeps the responses to requests with an idempotency key,
+// and makes requests with the key of one in flight wait for it
+type idempotencyCache struct {
+	ttl       time.Duration
+	responses *responseCache
+
+	mu       sync.Mutex
+	inFlight map[string]chan struct{}
+}
+
+// newIdempotencyCache creates idempotencyCache keeping responses for ttl. It
+// returns nil when ttl is not positive, for no deduplication
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &idempotencyCache{
+		ttl:       ttl,
+		responses: newResponseCache(idempotencyMaxEntries),
+		inFlight:  make(map[string]chan struct{}),
+	}
+}
+
+// ErrNotReplayable is returned for requests repeating the Idempotency-Key of
+// an earlier one whose response could not be stored, see Config.IdempotencyTTL
+var ErrNotReplayable = errors.New("proxy: response to the idempotency key was not stored")
+
+// idempotencyKey of r, scoped to its method and path, and to the client
+// sending it: its credentials, or its address without any, so that clients
+// can't get each other's responses by reusing a key. It's empty for requests
+// without the header
+func idempotencyKey(r *http.Request, clientIP string) string {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" {
+		return ""
+	}
+	client := clientIP
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		// hashed, so that credentials aren't kept around in memory
+		sum := sha256.Sum256([]byte(auth))
+		client = hex.EncodeToString(sum[:])
+	}
+	return r.Method + " " + r.URL.Path + "\x00" + client + "\x00" + key
+}
+
+// acquire returns the response stored under key, waiting for a request in
+// flight with the same key first. Without a stored response, the caller
+// holds key and must release it once its response is stored or failed
+func (c *idempotencyCache) acquire(ctx context.Context, key string) (*cacheEntry, error) {
+	for {
+		c.mu.Lock()
+		if e := c.responses.get(key, time.Now()); e != nil {
+			c.mu.Unlock()
+			return e, nil
+		}
+		wait, ok := c.inFlight[key]
+		if !ok {
+			c.inFlight[key] = make(chan struct{})
+			c.mu.Unlock()
+			return nil, nil
+		}
+		c.mu.Unlock()
+
+		// the request in flight may fail without storing a response, then
+		// one of the waiting ones takes over
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release key, letting the requests waiting for it through
+func (c *idempotencyCache) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	close(c.inFlight[key])
+	delete(c.inFlight, key)
+}
+
+// idempotentTransport replays the stored response of a request with an
+// idempotency key, or stores the upstream one
+type idempotentTransport struct {
+	next  http.RoundTripper
+	cache *idempotencyCache
+	key   string
+	d     *Data
+}
+
+func (t *idempotentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	e, err := t.cache.acquire(req.Context(), t.key)
+	if err != nil {
+		return nil, err
+	}
+	if e != nil {
+		t.d.Deduplicated = true
+		// the upstream was not contacted
+		t.d.Upstream = ""
+		t.d.UpstreamURL = ""
+		if e.incomplete {
+			return nil, &rejection{status: http.StatusConflict, err: ErrNotReplayable, message: "response to this Idempotency-Key is not available"}
+		}
+		return e.response(req), nil
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.cache.release(t.key)
+		return nil, err
+	}
+
+	rec := &idempotencyRecorder{
+		cacheRecorder: &cacheRecorder{ReadCloser: res.Body, cache: t.cache.responses, buf: captureBuffer{limit: maxCachedBodyBytes}},
+		release:       func() { t.cache.release(t.key) },
+	}
+	// server errors are worth retrying, they are not stored
+	if res.StatusCode < http.StatusInternalServerError {
+		now := time.Now()
+		rec.entry = &cacheEntry{key: t.key, status: res.StatusCode, header: res.Header.Clone(), stored: now, expires: now.Add(t.cache.ttl)}
+		// there's nothing to read of the body before storing the response
+		if bodyless(res) {
+			t.cache.responses.put(rec.entry)
+			rec.entry = nil
+		}
+	}
+	res.Body = rec
+	return res, nil
+}
+
+// idempotencyRecorder stores the response body into the cache like
+// cacheRecorder, and releases the idempotency key once the body is closed
+type idempotencyRecorder struct {
+	*cacheRecorder
+	release func()
+	once    sync.Once
+}
+
+func (r *idempotencyRecorder) Close() error {
+	err := r.cacheRecorder.Close()
+	r.once.Do(func() {
+		// the request took effect, but its response wasn't kept whole, being
+		// too large or not read to the end: it must not take effect again
+		if r.entry != nil {
+			r.entry.incomplete = true
+			r.cache.put(r.entry)
+			r.entry = nil
+		}
+		r.release()
+	})
+	return err
+}
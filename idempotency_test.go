@@ -0,0 +1,196 @@
+package proxy_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyReplay(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "payment %d", n)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:      target.URL,
+		Timeout:        timeout,
+		DataChan:       mchan,
+		IdempotencyTTL: time.Minute,
+	})
+	require.NoError(t, err)
+
+	pay := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/payments", strings.NewReader(requestBody))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+
+	w := pay("key-1")
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.Equal(t, "payment 1", w.Body.String())
+	require.False(t, (<-mchan).Deduplicated)
+
+	w = pay("key-1")
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.Equal(t, "payment 1", w.Body.String())
+	data := <-mchan
+	require.True(t, data.Deduplicated)
+	require.Empty(t, data.Upstream)
+
+	// other keys and requests without one are forwarded
+	require.Equal(t, "payment 2", pay("key-2").Body.String())
+	require.Equal(t, "payment 3", pay("").Body.String())
+	require.Equal(t, int32(3), atomic.LoadInt32(&hits))
+}
+
+func TestIdempotencyConcurrent(t *testing.T) {
+	const requests = 5
+	mchan := make(chan proxy.Data, requests)
+
+	var hits int32
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		w.Write([]byte(responseBody))
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:      target.URL,
+		Timeout:        timeout,
+		DataChan:       mchan,
+		IdempotencyTTL: time.Minute,
+	})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	bodies := make([]string, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/payments", strings.NewReader(requestBody))
+			req.Header.Set("Idempotency-Key", "key")
+			w := httptest.NewRecorder()
+			h(w, req)
+			bodies[i] = w.Body.String()
+		}(i)
+	}
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&hits) == 1 }, time.Second, time.Millisecond)
+	// give the others the time to pile up behind the first one
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&hits))
+	deduplicated := 0
+	for i := 0; i < requests; i++ {
+		require.Equal(t, responseBody, bodies[i])
+		if (<-mchan).Deduplicated {
+			deduplicated++
+		}
+	}
+	require.Equal(t, requests-1, deduplicated)
+}
+
+func TestIdempotencyClients(t *testing.T) {
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		fmt.Fprintf(w, "payment %d for %s", n, r.Header.Get("Authorization"))
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{TargetURL: target.URL, Timeout: timeout, IdempotencyTTL: time.Minute})
+	require.NoError(t, err)
+
+	pay := func(auth, remoteAddr string) string {
+		req := httptest.NewRequest(http.MethodPost, "/payments", strings.NewReader(requestBody))
+		req.Header.Set("Idempotency-Key", "key")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w.Body.String()
+	}
+
+	// a key reused by another client doesn't give it the response of the first
+	require.Equal(t, "payment 1 for alice", pay("alice", "10.0.0.1:1234"))
+	require.Equal(t, "payment 2 for bob", pay("bob", "10.0.0.1:1234"))
+	require.Equal(t, "payment 1 for alice", pay("alice", "10.0.0.2:1234"))
+
+	// without credentials, clients are told apart by their address
+	require.Equal(t, "payment 3 for ", pay("", "10.0.0.1:1234"))
+	require.Equal(t, "payment 4 for ", pay("", "10.0.0.2:1234"))
+	require.Equal(t, "payment 3 for ", pay("", "10.0.0.1:4321"))
+}
+
+func TestIdempotencyNotStored(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+	largeBody := strings.Repeat("0123456789", 200000)
+
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/large":
+			w.Write([]byte(largeBody))
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:      target.URL,
+		Timeout:        timeout,
+		DataChan:       mchan,
+		IdempotencyTTL: time.Minute,
+	})
+	require.NoError(t, err)
+
+	send := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(requestBody))
+		req.Header.Set("Idempotency-Key", "key")
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+
+	// too large to store, the response can't be replayed, nor the request repeated
+	require.Equal(t, largeBody, send("/large").Body.String())
+	<-mchan
+	w := send("/large")
+	require.Equal(t, http.StatusConflict, w.Code)
+	require.Equal(t, int32(1), atomic.LoadInt32(&hits))
+	require.Len(t, mchan, 0, "rejected requests must not be published")
+
+	// responses without a body are stored without reading one
+	require.Equal(t, http.StatusNoContent, send("/empty").Code)
+	require.Equal(t, http.StatusNoContent, send("/empty").Code)
+	require.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	require.False(t, (<-mchan).Deduplicated)
+	require.True(t, (<-mchan).Deduplicated)
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// locationTransport rewrites the Location of redirects to the upstream, see
+// Config.RewriteLocation. It wraps the cache and coalescing, which keep the
+// Location of the upstream, so that each client gets its own
+type locationTransport struct {
+	next   http.RoundTripper
+	target *url.URL
+	public *url.URL
+	cfg    *Config
+}
+
+func (t *locationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil || res.StatusCode < 300 || res.StatusCode > 399 {
+		return res, err
+	}
+	if loc := res.Header.Get("Location"); loc != "" {
+		res.Header.Set("Location", rewriteLocation(loc, t.target, t.public, t.cfg))
+	}
+	return res, nil
+}
+
+// publicURL returns the base URL clients reach the proxy at: Config.PublicURL,
+// or the scheme and host r came with
+func publicURL(r *http.Request, cfg *Config) *url.URL {
+	if cfg.PublicURL != "" {
+		// validated along with the config
+		u, _ := url.Parse(cfg.PublicURL)
+		return u
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return &url.URL{Scheme: scheme, Host: r.Host}
+}
+
+// rewriteLocation maps an absolute Location pointing at target to the same
+// resource behind the proxy at public, reverting the path rewriting of cfg.
+// Other locations, like relative ones, are returned unchanged
+func rewriteLocation(loc string, target, public *url.URL, cfg *Config) string {
+	u, err := url.Parse(loc)
+	if err != nil || !u.IsAbs() || !strings.EqualFold(u.Host, target.Host) {
+		return loc
+	}
+
+	path := u.Path
+	if target.Path != "" && hasPathPrefix(path, target.Path) {
+		path = strings.TrimPrefix(path, strings.TrimSuffix(target.Path, "/"))
+	}
+	if cfg.AddPrefix != "" && hasPathPrefix(path, cfg.AddPrefix) {
+		path = strings.TrimPrefix(path, strings.TrimSuffix(cfg.AddPrefix, "/"))
+	}
+	if cfg.StripPrefix != "" {
+		path = joinPath(cfg.StripPrefix, path)
+	}
+	path = joinPath(public.Path, path)
+	if path == "" {
+		path = "/"
+	}
+
+	u.Scheme, u.Host = public.Scheme, public.Host
+	u.Path, u.RawPath = path, ""
+	return u.String()
+}
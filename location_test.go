@@ -0,0 +1,118 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewriteLocation(t *testing.T) {
+	var location string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer target.Close()
+
+	cases := map[string]struct {
+		publicURL, location, expected string
+	}{
+		"absolute to upstream":     {"https://example.com", target.URL + "/base/login?next=%2F", "https://example.com/api/login?next=%2F"},
+		"public base path":         {"https://example.com/app", target.URL + "/base/login", "https://example.com/app/api/login"},
+		"request host":             {"", target.URL + "/base/login", "http://proxy.example.com/api/login"},
+		"relative":                 {"https://example.com", "/base/login", "/base/login"},
+		"other host":               {"https://example.com", "https://sso.example.org/login", "https://sso.example.org/login"},
+		"upstream host other port": {"https://example.com", "http://127.0.0.1:1/base/login", "http://127.0.0.1:1/base/login"},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL:       target.URL + "/base",
+				Timeout:         timeout,
+				StripPrefix:     "/api",
+				RewriteLocation: true,
+				PublicURL:       c.publicURL,
+			})
+			require.NoError(t, err)
+
+			location = c.location
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://proxy.example.com/api/users", nil))
+			require.Equal(t, http.StatusFound, rec.Code)
+			require.Equal(t, c.expected, rec.Header().Get("Location"))
+		})
+	}
+}
+
+func TestRewriteLocationDisabled(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://"+r.Host+"/login", http.StatusFound)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{TargetURL: target.URL, Timeout: timeout, PublicURL: "https://example.com"})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, target.URL+"/login", rec.Header().Get("Location"))
+}
+
+func TestRewriteLocationShared(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			<-release
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		http.Redirect(w, r, "http://"+r.Host+"/login", http.StatusMovedPermanently)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:       target.URL,
+		Timeout:         timeout,
+		RewriteLocation: true,
+		Coalesce:        true,
+		CacheMaxEntries: 10,
+	})
+	require.NoError(t, err)
+
+	location := func(host string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		require.Equal(t, http.StatusMovedPermanently, rec.Code)
+		return rec.Header().Get("Location")
+	}
+
+	// each client gets the Location for its own host, also when it's joining
+	// the request of another one
+	var wg sync.WaitGroup
+	locations := make([]string, 2)
+	for i, host := range []string{"one.example.com", "two.example.com"} {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			locations[i] = location(host)
+		}(i, host)
+		if i == 0 {
+			require.Eventually(t, func() bool { return atomic.LoadInt32(&hits) == 1 }, timeout, time.Millisecond)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&hits), "the requests must be coalesced")
+	require.Equal(t, []string{"http://one.example.com/login", "http://two.example.com/login"}, locations)
+
+	// and when the redirect is cached, or not
+	require.Equal(t, "http://three.example.com/login", location("three.example.com"))
+	require.Equal(t, "http://four.example.com/login", location("four.example.com"))
+}
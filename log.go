@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// LogFormat selects how access log lines are rendered
+type LogFormat int
+
+const (
+	// LogPlain writes tab-separated lines with the request ID, URL and
+	// status to the standard logger
+	LogPlain LogFormat = iota
+	// LogApache writes lines in the Apache Common Log Format, followed by
+	// the request duration in microseconds
+	LogApache
+	// LogJSON writes a JSON object per line
+	LogJSON
+	// LogNone disables access logging
+	LogNone
+)
+
+// clfTime is the timestamp layout of the Common Log Format
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// jsonLine is the access log line of LogJSON
+type jsonLine struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"request_id"`
+	ClientIP      string    `json:"client_ip"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	Status        int       `json:"status"`
+	RequestBytes  int64     `json:"request_bytes"`
+	ResponseBytes int64     `json:"response_bytes"`
+	DurationMS    float64   `json:"duration_ms"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// newAccessLog returns the logger writing the Apache and JSON formats, which
+// go to LogOutput without the timestamp prefix of the standard logger
+func newAccessLog(cfg *Config) *log.Logger {
+	var out io.Writer = cfg.LogOutput
+	if out == nil {
+		out = log.Writer()
+	}
+	return log.New(out, "", 0)
+}
+
+// logRequest writes the access log line of a proxied request in the format of
+// cfg. A structured logger gets the latency breakdown computed from d.Times,
+// while the plain format only gets the request ID, URL and status. Responses
+// interrupted midway are told apart from failures to get a response at all
+func logRequest(cfg *Config, access *log.Logger, r *http.Request, d *Data) {
+	switch {
+	case cfg.LogFormat == LogNone:
+		return
+	case cfg.Logger != nil:
+		logStructured(cfg.Logger, r, d)
+		return
+	case cfg.LogFormat == LogApache:
+		size := "-"
+		if d.ResponseBytes > 0 {
+			size = fmt.Sprint(d.ResponseBytes)
+		}
+		access.Printf("%s - - [%s] %q %d %s %d", d.ClientIP, d.Times.Start.Format(clfTime),
+			r.Method+" "+r.RequestURI+" "+r.Proto, d.StatusCode, size, d.Times.Total().Microseconds())
+		return
+	case cfg.LogFormat == LogJSON:
+		line := jsonLine{
+			Time:          d.Times.Start,
+			RequestID:     d.RequestID,
+			ClientIP:      d.ClientIP,
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			Status:        d.StatusCode,
+			RequestBytes:  d.RequestBytes,
+			ResponseBytes: d.ResponseBytes,
+			DurationMS:    milliseconds(d.Times.Total()),
+		}
+		if d.Error != nil {
+			line.Error = d.Error.Error()
+		}
+		b, err := json.Marshal(line)
+		if err != nil {
+			return
+		}
+		access.Print(string(b))
+		return
+	}
+
+	if d.ResponseInterrupted {
+		log.Printf("%s\t%s\t%d\tresponse interrupted: %s\n", d.RequestID, r.URL, d.StatusCode, d.Error.Error())
+		return
+	}
+	if d.Error != nil {
+		log.Printf("%s\t%s\t%d\t%s\n", d.RequestID, r.URL, d.StatusCode, d.Error.Error())
+		return
+	}
+	log.Printf("%s\t%s\t%d\n", d.RequestID, r.URL, d.StatusCode)
+}
+
+// logStructured writes the access log line of a proxied request to logger
+func logStructured(logger *slog.Logger, r *http.Request, d *Data) {
+	attrs := []any{
+		slog.String("request_id", d.RequestID),
+		slog.String("method", r.Method),
+		slog.String("url", r.URL.String()),
+		slog.Int("status", d.StatusCode),
+		slog.Duration("write_request", elapsed(d.Times.Start, d.Times.WroteRequest)),
+		slog.Duration("ttfb", d.Times.TTFB()),
+		slog.Duration("total", d.Times.Total()),
+	}
+	if d.Error != nil {
+		attrs = append(attrs, slog.String("error", d.Error.Error()))
+	}
+	switch {
+	case d.ResponseInterrupted:
+		logger.Error("proxied response interrupted", attrs...)
+		return
+	case d.Error != nil:
+		logger.Error("proxy request failed", attrs...)
+		return
+	}
+	logger.Info("proxied request", attrs...)
+}
+
+// logSlow warns about a request taking longer than cfg.SlowThreshold, with
+// its latency breakdown, whatever the access log format is
+func logSlow(cfg *Config, r *http.Request, d *Data) {
+	if cfg.SlowThreshold <= 0 || d.Upgraded || d.Times.Total() <= cfg.SlowThreshold {
+		return
+	}
+	if cfg.Logger != nil {
+		cfg.Logger.Warn("slow proxied request",
+			slog.String("request_id", d.RequestID),
+			slog.String("method", r.Method),
+			slog.String("url", r.URL.String()),
+			slog.Int("status", d.StatusCode),
+			slog.Duration("threshold", cfg.SlowThreshold),
+			slog.Duration("write_request", elapsed(d.Times.Start, d.Times.WroteRequest)),
+			slog.Duration("dns", d.Times.DNSLookup()),
+			slog.Duration("connect", d.Times.Connect()),
+			slog.Duration("upstream", d.Times.UpstreamLatency()),
+			slog.Duration("ttfb", d.Times.TTFB()),
+			slog.Duration("total", d.Times.Total()),
+		)
+		return
+	}
+	log.Printf("WARN slow request\t%s\t%s\t%d\t%s\n", d.RequestID, r.URL, d.StatusCode, d.Times)
+}
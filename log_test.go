@@ -0,0 +1,144 @@
+package proxy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStructuredLog(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	buf := &bytes.Buffer{}
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL: target.URL,
+		Timeout:   timeout,
+		DataChan:  mchan,
+		Logger:    slog.New(slog.NewJSONHandler(buf, nil)),
+	})
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodPost, requestHeaders)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	require.Equal(t, "INFO", line["level"])
+	require.Equal(t, "/some/path", line["url"])
+	require.Equal(t, float64(http.StatusOK), line["status"])
+	require.Equal(t, res.Header.Get("X-Request-ID"), line["request_id"])
+	for _, k := range []string{"write_request", "ttfb", "total"} {
+		require.Contains(t, line, k)
+		require.True(t, line[k].(float64) > 0, "%s must be measured", k)
+	}
+}
+
+func TestLogFormat(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	logged := func(t *testing.T, format proxy.LogFormat) string {
+		buf := &bytes.Buffer{}
+		h, err := proxy.NewHandlerWithConfig(proxy.Config{
+			TargetURL: target.URL,
+			Timeout:   timeout,
+			LogFormat: format,
+			LogOutput: buf,
+		})
+		require.NoError(t, err)
+
+		res := doRequest(t, h, http.MethodPost, nil)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		return buf.String()
+	}
+
+	t.Run("json", func(t *testing.T) {
+		var line map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(logged(t, proxy.LogJSON)), &line))
+		require.Equal(t, http.MethodPost, line["method"])
+		require.Equal(t, "/some/path", line["path"])
+		require.Equal(t, float64(http.StatusOK), line["status"])
+		require.Equal(t, float64(len(requestBody)), line["request_bytes"])
+		require.Equal(t, float64(len(responseBody)), line["response_bytes"])
+		require.True(t, line["duration_ms"].(float64) > 0)
+		require.NotContains(t, line, "error")
+	})
+
+	t.Run("apache", func(t *testing.T) {
+		clf := regexp.MustCompile(`^127\.0\.0\.1 - - \[[^\]]+\] "POST /some/path HTTP/1\.1" 200 \d+ \d+\n$`)
+		require.Regexp(t, clf, logged(t, proxy.LogApache))
+	})
+
+	t.Run("none", func(t *testing.T) {
+		require.Empty(t, logged(t, proxy.LogNone))
+	})
+}
+
+func TestSlowLog(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	t.Run("structured", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		h, err := proxy.NewHandlerWithConfig(proxy.Config{
+			TargetURL:     target.URL,
+			Timeout:       timeout,
+			Logger:        slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelWarn})),
+			SlowThreshold: 20 * time.Millisecond,
+		})
+		require.NoError(t, err)
+
+		h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fast", nil))
+		require.Empty(t, buf.String(), "fast requests must not be warned about")
+
+		h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+		var line map[string]interface{}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+		require.Equal(t, "WARN", line["level"])
+		require.Equal(t, "slow proxied request", line["msg"])
+		require.Equal(t, "/slow", line["url"])
+		require.Equal(t, float64(20*time.Millisecond), line["threshold"])
+		require.True(t, line["total"].(float64) >= float64(50*time.Millisecond))
+		require.True(t, line["ttfb"].(float64) >= float64(50*time.Millisecond))
+	})
+
+	t.Run("standard logger", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		log.SetOutput(buf)
+		defer log.SetOutput(os.Stderr)
+
+		// the warning is written whatever the access log format is
+		h, err := proxy.NewHandlerWithConfig(proxy.Config{
+			TargetURL:     target.URL,
+			Timeout:       timeout,
+			LogFormat:     proxy.LogNone,
+			SlowThreshold: 20 * time.Millisecond,
+		})
+		require.NoError(t, err)
+
+		h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+		require.Regexp(t, regexp.MustCompile(`WARN slow request\t[0-9a-f]+\t/slow\t200\ttotal=\S+ ttfb=\S+ upstream=\S+`), buf.String())
+	})
+}
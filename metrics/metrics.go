@@ -0,0 +1,76 @@
+// Package metrics exposes Prometheus metrics of requests proxied by the proxy
+// package handlers
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector of proxied request metrics: a counter of requests by status code,
+// a counter of proxy errors, a histogram of request durations and a gauge of
+// requests in flight
+type Collector struct {
+	requests *prometheus.CounterVec
+	errors   prometheus.Counter
+	duration prometheus.Histogram
+	inFlight prometheus.Gauge
+}
+
+// NewCollector creates Collector and registers its metrics with reg
+func NewCollector(reg prometheus.Registerer) (*Collector, error) {
+	c := &Collector{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_requests_total",
+			Help: "Number of proxied requests by response status code.",
+		}, []string{"code"}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proxy_errors_total",
+			Help: "Number of requests which failed to be proxied.",
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "proxy_request_duration_seconds",
+			Help:    "Total time spent handling proxied requests.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "proxy_requests_in_flight",
+			Help: "Number of requests being proxied.",
+		}),
+	}
+
+	for _, m := range []prometheus.Collector{c.requests, c.errors, c.duration, c.inFlight} {
+		if err := reg.Register(m); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Callback counts a completed request by its status code and error. Use it as
+// proxy.Config.Callback, or call it from one
+func (c *Collector) Callback(status int, err error) {
+	c.requests.WithLabelValues(strconv.Itoa(status)).Inc()
+	if err != nil {
+		c.errors.Inc()
+	}
+}
+
+// Handler wraps h, tracking the number of requests in flight and their duration
+func (c *Collector) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.inFlight.Inc()
+		defer c.inFlight.Dec()
+
+		start := time.Now()
+		defer func() {
+			c.duration.Observe(time.Since(start).Seconds())
+		}()
+
+		h.ServeHTTP(w, r)
+	})
+}
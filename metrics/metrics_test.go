@@ -0,0 +1,67 @@
+package metrics_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redstarnv/proxy"
+	"github.com/redstarnv/proxy/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollector(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "bam")
+	}))
+	defer target.Close()
+
+	reg := prometheus.NewRegistry()
+	c, err := metrics.NewCollector(reg)
+	require.NoError(t, err)
+
+	h, err := proxy.NewHandler(target.URL, time.Second, nil, c.Callback)
+	require.NoError(t, err)
+	instrumented := c.Handler(h)
+
+	for i := 0; i < 2; i++ {
+		instrumented.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	// broken upstream
+	target.Close()
+	instrumented.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	expected := `
+# HELP proxy_requests_total Number of proxied requests by response status code.
+# TYPE proxy_requests_total counter
+proxy_requests_total{code="200"} 2
+proxy_requests_total{code="502"} 1
+# HELP proxy_errors_total Number of requests which failed to be proxied.
+# TYPE proxy_errors_total counter
+proxy_errors_total 1
+# HELP proxy_requests_in_flight Number of requests being proxied.
+# TYPE proxy_requests_in_flight gauge
+proxy_requests_in_flight 0
+`
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"proxy_requests_total", "proxy_errors_total", "proxy_requests_in_flight"))
+
+	count, err := testutil.GatherAndCount(reg, "proxy_request_duration_seconds")
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestCollectorDuplicateRegistration(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	_, err := metrics.NewCollector(reg)
+	require.NoError(t, err)
+
+	_, err = metrics.NewCollector(reg)
+	require.Error(t, err)
+}
@@ -0,0 +1,17 @@
+package proxy
+
+import "net/http"
+
+// Middleware wraps an http.Handler with additional behaviour, like
+// authentication or header injection
+type Middleware func(http.Handler) http.Handler
+
+// WithMiddleware wraps h with mw, the first of which sees requests first.
+// Requests a middleware answers itself never reach h, so if h is a proxy
+// handler, no Data is published for them
+func WithMiddleware(h http.Handler, mw ...Middleware) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
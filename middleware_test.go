@@ -0,0 +1,55 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithMiddleware(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, r.Header.Get("X-Order"), nil)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandler(target.URL, timeout, mchan, nil)
+	require.NoError(t, err)
+
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	tag := func(name string) proxy.Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.Header.Add("X-Order", name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	wrapped := proxy.WithMiddleware(h, auth, tag("first"), tag("second"))
+
+	w := httptest.NewRecorder()
+	wrapped.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Len(t, mchan, 0, "requests stopped by middleware must not be published")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	wrapped.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "first", w.Body.String(), "middleware must run in order")
+	require.Len(t, mchan, 1)
+	require.Equal(t, []string{"first", "second"}, (<-mchan).RequestHeader.Values("X-Order"))
+}
@@ -2,143 +2,1192 @@ package proxy
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"mime"
 	"net"
 	"net/http"
 	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Data consisting of request/response proxied through the service
+// Data consisting of request/response proxied through the service.
+// Request and Response are nil when capturing the corresponding body is disabled
 type Data struct {
-	StatusCode     int
-	Request        io.Reader
-	Response       io.Reader
-	Error          error
-	Times          Times
+	StatusCode int
+	Request    io.Reader
+	Response   io.Reader
+	Error      error
+	Times      Times
+
+	// ResponseHeader of the upstream response and RequestHeader of the incoming
+	// request. They are copies, safe to read after the handler returns
 	ResponseHeader http.Header
 	RequestHeader  http.Header
+
+	// RequestCaptureTruncated and ResponseCaptureTruncated report that the
+	// corresponding body was larger than the capture limit, and Request/Response
+	// only hold its first bytes
+	RequestCaptureTruncated  bool
+	ResponseCaptureTruncated bool
+
+	// Retries is the number of times the upstream request was retried
+	// after a connection error
+	Retries int
+
+	// RetryAfterWait is how long the proxy waited to retry the request after
+	// the upstream answered 503 with Retry-After, see Config.HonorRetryAfter
+	RetryAfterWait time.Duration
+
+	// Upgraded is set when the connection switched protocols (e.g. to WebSocket)
+	// and was spliced through to the upstream without capturing the traffic
+	Upgraded bool
+
+	// ResponseInterrupted is set when forwarding the response body failed after
+	// the status and headers were sent to the client. StatusCode is the one of
+	// the upstream response then, and the client got a truncated body
+	ResponseInterrupted bool
+
+	// ResponseTruncated is set when the response body was cut off at
+	// Config.MaxResponseBodyBytes. Unlike ResponseCaptureTruncated, the client
+	// only got the first bytes of it
+	ResponseTruncated bool
+
+	// Upstream is the host of the upstream server the request was proxied to
+	Upstream string
+	// UpstreamURL is the URL the request was proxied to, after rewriting.
+	// Upstreams listening on a Unix domain socket have the host "unix" in it
+	UpstreamURL string
+
+	// RequestBytes and ResponseBytes count body bytes proxied in each
+	// direction, whether the bodies are captured or not
+	RequestBytes  int64
+	ResponseBytes int64
+
+	// ErrorKind classifies Error, or a 5xx response of the upstream
+	ErrorKind ErrorKind
+
+	// ClientIP is the address of the client, taken from X-Forwarded-For when
+	// the request came through Config.TrustedProxies
+	ClientIP string
+
+	// ClientStatusCode is the status of the forwarded response sent to the
+	// client. It differs from StatusCode, the one of the upstream, when
+	// rewritten by Config.StatusRewriter. It's also the status of
+	// Config.Fallback when sent instead of an error response
+	ClientStatusCode int
+
+	// ConnReused is set when the upstream connection was taken from the pool
+	// of idle ones, which it spent ConnIdleTime in
+	ConnReused   bool
+	ConnIdleTime time.Duration
+
+	// Timeout is the limit of the upstream exchange the request got, see
+	// Config.RequestTimeout and Config.MaxTimeoutOverride. Zero means none
+	Timeout time.Duration
+
+	// CacheHit is set when the response was served from the cache, see
+	// Config.CacheMaxEntries. Upstream and UpstreamURL are empty then
+	CacheHit bool
+
+	// Sampled is set when the bodies of the request were captured, as far as
+	// enabled, see Config.Sampling
+	Sampled bool
+
+	// Queued is set when the request waited for one in flight to finish,
+	// for QueueWait, see Config.MaxConcurrent
+	Queued    bool
+	QueueWait time.Duration
+
+	// Deduplicated is set when the request repeated the Idempotency-Key of an
+	// earlier one and got its stored response, see Config.IdempotencyTTL.
+	// Upstream and UpstreamURL are empty then
+	Deduplicated bool
+
+	// Coalesced is set when the request got the response of an identical one
+	// in flight, or its error, see Config.Coalesce. Upstream and UpstreamURL
+	// are empty then
+	Coalesced bool
+
+	// RequestID identifies the request in the X-Request-ID header sent to the
+	// upstream and back to the client. It's taken from the incoming request
+	// when present, and generated otherwise
+	RequestID string
 }
 
-// upstream definition for the server we're proxying data to
-type upstream struct {
-	target url.URL
+// number of Data items not published because the channel was full
+var dropped uint64
+
+// Dropped returns how many Data items were discarded because the Data channel
+// was full at the time the request completed
+func Dropped() uint64 {
+	return atomic.LoadUint64(&dropped)
 }
 
-// Times is struct to store request time
-type Times struct {
-	Start                time.Time
-	WroteRequest         time.Time
-	GotFirstResponseByte time.Time
-	End                  time.Time
+// NewHandler creates http.HandlerFunc that proxies requests
+// to the given URL. cb, when not nil, is called once per request with the
+// final status code and the proxy error (nil on success). Both request and
+// response bodies are captured into Data, published to ch unless it's nil
+func NewHandler(targetURL string, timeout time.Duration, ch chan<- Data, cb func(status int, err error), opts ...Option) (http.HandlerFunc, error) {
+	cfg := Config{
+		TargetURL:       targetURL,
+		Timeout:         timeout,
+		DataChan:        ch,
+		Callback:        cb,
+		CaptureRequest:  true,
+		CaptureResponse: true,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return NewHandlerWithConfig(cfg)
 }
 
-// maximum of idle upstream connections to keep open
-const httpMaxIdleConns = 256
+// NewHandlerWithConfig creates http.HandlerFunc that proxies requests
+// as described by cfg
+func NewHandlerWithConfig(cfg Config) (http.HandlerFunc, error) {
+	return newConfiguredHandler(cfg, &counters{})
+}
 
-// NewHandler creates http.HandlerFunc that proxies requests
-// to the given URL
-func NewHandler(targetURL string, timeout time.Duration, ch chan<- Data) (http.HandlerFunc, error) {
-	u, err := url.Parse(targetURL)
+// newConfiguredHandler creates the handler described by cfg, counting its
+// requests into c
+func newConfiguredHandler(cfg Config, c *counters) (http.HandlerFunc, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.loadTLS(); err != nil {
+		return nil, err
+	}
+	if err := cfg.loadSchema(); err != nil {
+		return nil, err
+	}
+	if len(cfg.Targets) > 0 || len(cfg.WeightedTargets) > 0 {
+		if cfg.TargetURL != "" {
+			return nil, errors.New("proxy: target URL and targets are mutually exclusive")
+		}
+		b, err := newPoolBalancer(&cfg)
+		if err != nil {
+			return nil, err
+		}
+		return newHandler(cfg, b, c), nil
+	}
+
+	u, err := newUpstream(cfg.TargetURL)
 	if err != nil {
 		return nil, err
 	}
-	transport := newTransport(timeout)
+
+	return newHandler(cfg, u, c), nil
+}
+
+// newHandler creates http.HandlerFunc proxying every request to the upstream
+// picked by b
+func newHandler(cfg Config, b balancer, c *counters) http.HandlerFunc {
+	transport := cfg.Transport
+	if transport == nil {
+		transport = newTransport(&cfg)
+	}
+	limiter := newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+	cache := newResponseCache(cfg.CacheMaxEntries)
+	idem := newIdempotencyCache(cfg.IdempotencyTTL)
+	group := newCoalescer(cfg.Coalesce)
+	sem := newBulkhead(cfg.MaxConcurrent)
+	access := newAccessLog(&cfg)
+	c.upstreams = members(b)
+	c.ready.probe = func(ctx context.Context) error {
+		up, err := b.pick(nil)
+		if err != nil {
+			return err
+		}
+		_, err = probe(ctx, up.roundTripper(transport, &cfg), &up.target, cfg.Timeout)
+		return err
+	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 
+		atomic.AddInt64(&c.inFlight, 1)
+		defer c.done()
+
+		if cfg.CORS != nil && preflight(r) {
+			cfg.CORS.answerPreflight(w, r)
+			return
+		}
+
 		var d Data
 		d.Times.Start = time.Now()
-		d.Error = handleRequest(transport, w, &d, r, u)
+		d.Error = handleRequest(transport, w, &d, r, b, limiter, sem, cache, idem, group, &cfg)
 		d.Times.End = time.Now()
+		if d.Error != nil && d.StatusCode == 0 {
+			d.StatusCode = http.StatusServiceUnavailable
+		}
 
-		ch <- d
+		d.ErrorKind = classifyError(d.Error, d.StatusCode)
 
-		if d.Error != nil {
-			log.Printf("%s\t%d\t%s\n", r.URL, http.StatusServiceUnavailable, d.Error.Error())
-			http.Error(w, d.Error.Error(), http.StatusServiceUnavailable)
-			return
+		var rej *rejection
+		rejected := errors.As(d.Error, &rej)
+		if rejected {
+			d.StatusCode = rej.status
 		}
 
-		log.Printf("%s\t%d\n", r.URL, d.StatusCode)
+		var fallback *FallbackResponse
+		if !rejected && cfg.Fallback != nil && unreachable(&d) {
+			if fallback = cfg.Fallback.response(r, d.Error); fallback != nil {
+				d.ClientStatusCode = fallback.status()
+			}
+		}
 
-	}, nil
+		c.status(d.StatusCode)
+		if cfg.Callback != nil {
+			cfg.Callback(d.StatusCode, d.Error)
+		}
+
+		// never let a slow consumer stall proxied traffic
+		if !rejected && cfg.DataChan != nil {
+			select {
+			case cfg.DataChan <- d:
+			default:
+				atomic.AddUint64(&dropped, 1)
+				atomic.AddUint64(&c.dropped, 1)
+			}
+		}
+
+		// a client going away says nothing about the upstream
+		if !rejected && r.Context().Err() == nil {
+			c.ready.observe(&d)
+		}
+
+		logRequest(&cfg, access, r, &d)
+		logSlow(&cfg, r, &d)
+
+		switch {
+		case d.ResponseInterrupted:
+			// the client already got the status and a part of the body, abort the
+			// connection so that it can't mistake the response for a complete one
+			panic(http.ErrAbortHandler)
+		case d.Error != nil && !d.Upgraded:
+			// the connection of an upgraded request is not ours to write to anymore
+			writeError(w, r, &d, fallback, &cfg)
+		}
+	}
+}
+
+// writeError sends the client the response for the failed request, or the
+// fallback for it when not nil. Error details are internal and only reach
+// the client through cfg.ErrorHandler, apart from the messages of rejections
+// meant for it
+func writeError(w http.ResponseWriter, r *http.Request, d *Data, fallback *FallbackResponse, cfg *Config) {
+	// let browsers read the failure too
+	if cfg.CORS != nil {
+		cfg.CORS.allowOrigin(w.Header(), r.Header.Get("Origin"))
+	}
+	if fallback != nil {
+		fallback.write(w)
+		return
+	}
+	if cfg.ErrorHandler != nil {
+		cfg.ErrorHandler(w, r, d.Error)
+		return
+	}
+	message := http.StatusText(d.StatusCode)
+	var rej *rejection
+	if errors.As(d.Error, &rej) && rej.message != "" {
+		message = rej.message
+	}
+	http.Error(w, message, d.StatusCode)
 }
 
-func handleRequest(transport *http.Transport, w http.ResponseWriter, d *Data, r *http.Request, u *url.URL) error {
-	req, err := prepareRequest(r, d, u)
+func handleRequest(transport http.RoundTripper, w http.ResponseWriter, d *Data, r *http.Request, b balancer, limiter *rateLimiter, sem bulkhead, cache *responseCache, idem *idempotencyCache, group *coalescer, cfg *Config) error {
+	d.RequestID = r.Header.Get(requestIDHeader)
+	if d.RequestID == "" {
+		d.RequestID = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, d.RequestID)
+	d.ClientIP = clientIP(r, cfg.TrustedProxies)
+
+	if limiter != nil {
+		if ok, wait := limiter.allow(d.ClientIP, time.Now()); !ok {
+			w.Header().Set("Retry-After", retryAfter(wait))
+			return &rejection{status: http.StatusTooManyRequests, err: ErrRateLimited}
+		}
+	}
+
+	if !methodAllowed(r.Method, cfg.AllowedMethods) {
+		w.Header().Set("Allow", strings.Join(cfg.AllowedMethods, ", "))
+		return &rejection{status: http.StatusMethodNotAllowed, err: ErrMethodNotAllowed}
+	}
+
+	// the upstream would resolve them past the prefixes matched here
+	if dotSegments(r.URL.Path) {
+		return &rejection{status: http.StatusBadRequest, err: ErrDotSegments}
+	}
+
+	if !pathAllowed(r.URL.Path, cfg.PathAllowlist) {
+		return &rejection{status: http.StatusNotFound, err: ErrPathNotAllowed}
+	}
+
+	// the body must not be read, let alone forwarded, if its length is in doubt
+	if ambiguousLength(r.Header, r.TransferEncoding) {
+		return &rejection{status: http.StatusBadRequest, err: ErrAmbiguousLength}
+	}
+
+	if cfg.Validate != nil {
+		if err := cfg.Validate(r); err != nil {
+			return &rejection{status: http.StatusBadRequest, err: fmt.Errorf("proxy: invalid request: %w", err), message: err.Error()}
+		}
+	}
+
+	if sem != nil {
+		if err := sem.acquire(r.Context(), d, cfg); err != nil {
+			return err
+		}
+		defer sem.release()
+	}
+
+	up, err := b.pick(r)
 	if err != nil {
 		return err
 	}
+	d.Upstream = up.name()
+	if cfg.StickyCookie != "" && len(cfg.Targets)+len(cfg.WeightedTargets) > 1 {
+		setStickyCookie(w, r, up, cfg.StickyCookie)
+	}
+	transport = &loadTransport{next: up.roundTripper(transport, cfg), up: up}
+
+	var reqBuf *captureBuffer
+	d.Sampled = !cfg.Sampling || sampled(r, cfg.SampleRate)
+	if cfg.CaptureRequest && d.Sampled {
+		reqBuf = &captureBuffer{limit: cfg.MaxCaptureBytes, spill: cfg.CaptureSpillBytes}
+		d.Request = reqBuf
+	}
+	var reqSink *sinkCapture
+	if reqBuf != nil && cfg.CaptureSink != nil {
+		// the sink gets the body as it streams, Data only the request ID
+		reqSink = newSinkCapture(cfg.CaptureSink.WriteRequest, d.RequestID, cfg.MaxCaptureBytes)
+		defer func() {
+			d.RequestCaptureTruncated = reqSink.close()
+		}()
+		reqBuf, d.Request = nil, nil
+	}
+
+	// stream the body through the capture buffer and count its bytes on the way
+	var body io.Reader = http.NoBody
+	reqCounter := &countingReader{}
+	var client *clientBody
+	var payload []byte
+	var buffered *bufferedBody
+	if r.Body == http.NoBody && schemaApplies(r, cfg) {
+		// no body is no valid JSON either
+		if err := validateSchema(nil, cfg); err != nil {
+			return err
+		}
+	}
+	if r.Body != http.NoBody {
+		client = &clientBody{r: r.Body}
+		if cfg.MaxRequestBodyBytes > 0 {
+			// a declared length is checked upfront, chunked bodies as they stream
+			if r.ContentLength > cfg.MaxRequestBodyBytes {
+				return &rejection{status: http.StatusRequestEntityTooLarge, err: ErrRequestTooLarge}
+			}
+			client.r = http.MaxBytesReader(w, r.Body, cfg.MaxRequestBodyBytes)
+		}
+		if cfg.ClientReadTimeout > 0 {
+			// the deadline covers reading the whole body, and is lifted once it's
+			// read, so that it doesn't cut the wait for the upstream short
+			rc := http.NewResponseController(w)
+			if rc.SetReadDeadline(time.Now().Add(cfg.ClientReadTimeout)) == nil {
+				client.onEOF = func() { rc.SetReadDeadline(time.Time{}) }
+			}
+		}
+		body = client
+		if cfg.BufferRequest {
+			// a slow client then holds no upstream connection open
+			if buffered, err = bufferBody(body, cfg.bufferMemoryBytes()); err != nil {
+				if rej := client.rejection(); rej != nil {
+					return rej
+				}
+				// the client is only to blame when its body couldn't be read, not
+				// when it couldn't be stored
+				d.StatusCode = http.StatusInternalServerError
+				if client.failed() {
+					d.StatusCode = http.StatusBadRequest
+				}
+				return fmt.Errorf("proxy: buffer request body: %w", err)
+			}
+			defer buffered.Close()
+			body = buffered
+		}
+		if schemaApplies(r, cfg) {
+			limit := cfg.MaxRequestBodyBytes
+			if limit <= 0 {
+				limit = maxValidatedBodyBytes
+			}
+			raw, err := io.ReadAll(io.LimitReader(body, limit+1))
+			if err != nil {
+				if rej := client.rejection(); rej != nil {
+					return rej
+				}
+				d.StatusCode = http.StatusBadRequest
+				return fmt.Errorf("proxy: read request body: %w", err)
+			}
+			if int64(len(raw)) > limit {
+				return &rejection{status: http.StatusRequestEntityTooLarge, err: ErrRequestTooLarge}
+			}
+			if err := validateSchema(raw, cfg); err != nil {
+				return err
+			}
+			body = bytes.NewReader(raw)
+		}
+		if cfg.RequestBodyTransform != nil {
+			if body, err = cfg.RequestBodyTransform(body); err != nil {
+				if rej := client.rejection(); rej != nil {
+					return rej
+				}
+				d.StatusCode = http.StatusInternalServerError
+				return fmt.Errorf("proxy: transform request body: %w", err)
+			}
+		}
+		if cfg.SigningSecret != nil {
+			// the signature goes in a header, the whole body must be known upfront
+			if payload, err = io.ReadAll(body); err != nil {
+				if rej := client.rejection(); rej != nil {
+					return rej
+				}
+				d.StatusCode = http.StatusBadRequest
+				return fmt.Errorf("proxy: read request body: %w", err)
+			}
+			body = bytes.NewReader(payload)
+		}
+		if reqBuf != nil {
+			body = io.TeeReader(body, reqBuf)
+		}
+		if reqSink != nil {
+			body = io.TeeReader(body, reqSink)
+		}
+		reqCounter.r = body
+		body = reqCounter
+	}
 
-	return process(transport, d, req, w)
+	upgrade := upgradeType(r.Header)
+	outgoing := r
+	d.Timeout = requestTimeout(r, cfg)
+	if d.Timeout > 0 && upgrade == "" {
+		ctx, cancel := context.WithTimeout(r.Context(), d.Timeout)
+		defer cancel()
+		outgoing = r.WithContext(ctx)
+	}
+
+	dt := &dialTrace{}
+	req, err := prepareRequest(outgoing, d, dt, &up.target, body, cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.SigningSecret != nil {
+		req.Header.Set(cfg.signatureHeader(), sign(cfg, req, payload))
+		req.ContentLength = int64(len(payload))
+	}
+	if buffered != nil && payload == nil && cfg.RequestBodyTransform == nil {
+		req.ContentLength = buffered.size
+	}
+
+	if upgrade == "" {
+		// keyed on the request as sent, which ModifyRequest may have rewritten
+		// for the caller, like with a tenant of its own, or given credentials
+		if group != nil && coalescable(r) && coalescable(req) {
+			transport = &coalescingTransport{next: transport, group: group, key: coalesceKey(req), d: d}
+		}
+		if cache != nil && cacheableRequest(r) && (cfg.ModifyRequest == nil || cacheableRequest(req)) {
+			transport = &cachingTransport{next: transport, cache: cache, key: cacheKey(req), d: d}
+		}
+		if key := idempotencyKey(r, d.ClientIP); idem != nil && key != "" {
+			transport = &idempotentTransport{next: transport, cache: idem, key: key, d: d}
+		}
+	}
+	if cfg.RewriteLocation {
+		// outermost, the public URL may be the host of this client, which must
+		// neither be cached nor shared with the others
+		transport = &locationTransport{next: transport, target: &up.target, public: publicURL(r, cfg), cfg: cfg}
+	}
+	if upgrade != "" {
+		err = processUpgrade(transport, d, req, w, upgrade, cfg)
+	} else {
+		err = process(transport, d, req, w, cfg)
+		if reqBuf != nil {
+			d.RequestCaptureTruncated = reqBuf.truncated
+		}
+	}
+	if reqBuf != nil {
+		if cfg.CaptureRedactor != nil {
+			d.Request = bytes.NewReader(cfg.CaptureRedactor(reqBuf.contents()))
+		} else {
+			d.Request = reqBuf.reader(cfg.captureSpillTTL())
+		}
+	}
+	d.RequestBytes = reqCounter.count()
+	dt.into(&d.Times)
+	if client != nil {
+		if rej := client.rejection(); rej != nil {
+			return rej
+		}
+	}
+
+	// a client going away says nothing about the upstream health, nor does a
+	// response the upstream wasn't asked for
+	if r.Context().Err() == nil && !replayed(d) {
+		up.report(err != nil || d.StatusCode >= http.StatusInternalServerError, cfg)
+	}
+	return err
 }
 
-func newTransport(timeout time.Duration) *http.Transport {
+// replayed reports whether d got a response, or an error, kept from another
+// request, without contacting the upstream
+func replayed(d *Data) bool {
+	return d.CacheHit || d.Deduplicated || d.Coalesced
+}
+
+// NewTransport creates the http.Transport sending requests upstream when
+// Config.Transport is nil. It's a starting point for a transport of one's
+// own, like one wrapped for instrumentation, which Config.Transport then
+// injects
+func NewTransport(cfg Config) (*http.Transport, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.loadTLS(); err != nil {
+		return nil, err
+	}
+	return newTransport(&cfg), nil
+}
+
+func newTransport(cfg *Config) *http.Transport {
 	return &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout:   timeout,
-			KeepAlive: timeout,
+		DialContext: withProxyHeader(cfg.ProxyProtocol, (&net.Dialer{
+			Timeout:   cfg.orDefault(cfg.DialTimeout),
+			KeepAlive: cfg.KeepAlive,
 			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          httpMaxIdleConns,
-		MaxIdleConnsPerHost:   httpMaxIdleConns,
-		IdleConnTimeout:       timeout,
-		ResponseHeaderTimeout: timeout,
-		ExpectContinueTimeout: 1 * time.Second,
+		}).DialContext),
+		// the PROXY protocol header is sent once per connection, so connections
+		// can't be shared by requests of different clients
+		DisableKeepAlives:     cfg.ProxyProtocol != 0,
+		MaxIdleConns:          cfg.maxIdleConns(),
+		MaxIdleConnsPerHost:   cfg.maxIdleConns(),
+		IdleConnTimeout:       cfg.orDefault(cfg.IdleConnTimeout),
+		ResponseHeaderTimeout: cfg.orDefault(cfg.ResponseHeaderTimeout),
+		ExpectContinueTimeout: cfg.expectContinueTimeout(),
+		TLSClientConfig:       cfg.TLSConfig.Clone(),
+		// HTTP/2 is only negotiated over TLS, via ALPN
+		ForceAttemptHTTP2: cfg.EnableHTTP2,
 	}
 }
 
-func process(transport *http.Transport, d *Data, req *http.Request, w http.ResponseWriter) error {
-	res, err := transport.RoundTrip(req)
+func process(transport http.RoundTripper, d *Data, req *http.Request, w http.ResponseWriter, cfg *Config) error {
+	res, err := roundTrip(transport, d, req, cfg)
 	if err != nil {
-		d.StatusCode = http.StatusServiceUnavailable
+		d.StatusCode = failureStatus(req, err)
 		return err
 	}
+
+	if ambiguousLength(res.Header, res.TransferEncoding) {
+		res.Body.Close()
+		d.StatusCode = http.StatusBadGateway
+		return ErrAmbiguousLength
+	}
+
+	if cfg.ModifyResponse != nil {
+		// a body replaced rather than wrapped must still be closed, or the
+		// round trip never ends, like for StrategyLeastConn
+		defer res.Body.Close()
+		if err := cfg.ModifyResponse(res); err != nil {
+			res.Body.Close()
+			d.StatusCode = http.StatusBadGateway
+			return fmt.Errorf("proxy: modify response: %w", err)
+		}
+	}
+
+	return forwardResponse(d, res, w, cfg)
+}
+
+// forwardResponse writes the upstream response to the client, capturing its body
+func forwardResponse(d *Data, res *http.Response, w http.ResponseWriter, cfg *Config) error {
 	d.StatusCode = res.StatusCode
-	d.ResponseHeader = res.Header
+	d.ResponseHeader = res.Header.Clone()
 
-	responseBuf := &bytes.Buffer{}
 	defer res.Body.Close()
 
+	var body io.Reader = res.Body
+	// resized is set when the body forwarded may differ in length from the one
+	// Content-Length announces
+	resized := res.Uncompressed || cfg.ResponseBodyTransform != nil
+	if bodyless(res) {
+		// nothing may follow the header, whatever a transform would make of it
+		body = http.NoBody
+	} else if cfg.ResponseBodyTransform != nil {
+		var err error
+		if body, err = cfg.ResponseBodyTransform(body); err != nil {
+			d.StatusCode = http.StatusInternalServerError
+			return fmt.Errorf("proxy: transform response body: %w", err)
+		}
+	}
+
+	// capped before the capture, which gets what the client gets
+	var limited *limitedReader
+	if cfg.MaxResponseBodyBytes > 0 {
+		limited = &limitedReader{r: body, n: cfg.MaxResponseBodyBytes}
+		body = limited
+		if res.ContentLength < 0 || res.ContentLength > cfg.MaxResponseBodyBytes {
+			resized = true
+		}
+	}
+
+	var responseBuf *captureBuffer
+	switch {
+	case !d.Sampled:
+		// only the metadata of requests left out of the sample is published
+	case cfg.CaptureSampleBytes > 0:
+		responseBuf = &captureBuffer{limit: cfg.CaptureSampleBytes, spill: cfg.CaptureSpillBytes}
+	case cfg.CaptureResponse:
+		responseBuf = &captureBuffer{limit: cfg.MaxCaptureBytes, spill: cfg.CaptureSpillBytes}
+	}
+	if responseBuf != nil && cfg.CaptureSink != nil {
+		sink := newSinkCapture(cfg.CaptureSink.WriteResponse, d.RequestID, responseBuf.limit)
+		defer func() {
+			d.ResponseCaptureTruncated = sink.close()
+		}()
+		body = io.TeeReader(body, sink)
+		responseBuf = nil
+	}
+	if responseBuf != nil {
+		body = io.TeeReader(body, responseBuf)
+		d.Response = responseBuf
+	}
+
 	copyHeaders(w.Header(), res.Header)
-	w.WriteHeader(res.StatusCode)
-	_, err = io.Copy(w, io.TeeReader(res.Body, responseBuf))
+	removeHopHeaders(w.Header())
+	clientHeaders(w.Header(), d, cfg)
+	if resized {
+		// a stale length would make keep-alive clients wait for bytes that never
+		// come, or read the end of the body as the next response. Send it chunked
+		w.Header().Del("Content-Length")
+	}
+	compress := cfg.CompressResponses && compressible(res, d.RequestHeader)
+	if compress {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		w.Header().Add("Vary", "Accept-Encoding")
+		if etag := w.Header().Get("ETag"); etag != "" {
+			w.Header().Set("ETag", weakETag(etag))
+		}
+	}
+	// the Trailer header was dropped with the hop-by-hop ones, announce the
+	// trailers of the upstream response to the client again
+	for k := range res.Trailer {
+		w.Header().Add("Trailer", k)
+	}
+
+	d.ClientStatusCode = res.StatusCode
+	if cfg.StatusRewriter != nil {
+		d.ClientStatusCode = cfg.StatusRewriter(res.StatusCode)
+	}
+	w.WriteHeader(d.ClientStatusCode)
+
+	var dst io.Writer = w
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		dst = gz
+	}
+	if f, ok := w.(http.Flusher); ok && streaming(res) {
+		f.Flush()
+		dst = flushWriter{w: dst, f: f}
+	}
+	n, err := io.Copy(dst, body)
+	if gz != nil && err == nil {
+		err = gz.Close()
+	}
+	d.ResponseBytes = n
+	d.ResponseInterrupted = err != nil
+	if limited != nil {
+		d.ResponseTruncated = limited.truncated
+	}
 
-	d.Response = responseBuf
+	// trailer values are only known once the body is read to the end
+	if err == nil {
+		for k, vs := range res.Trailer {
+			w.Header()[http.TrailerPrefix+k] = vs
+		}
+	}
+
+	if responseBuf != nil {
+		d.ResponseCaptureTruncated = responseBuf.truncated
+
+		if !cfg.DecodeCapturedBody && cfg.CaptureRedactor == nil {
+			d.Response = responseBuf.reader(cfg.captureSpillTTL())
+			return err
+		}
+
+		// the client got the encoded bytes, only the captured copy is decoded
+		captured := responseBuf.contents()
+		if cfg.DecodeCapturedBody {
+			if decoded, ok := decodeBody(res.Header.Get("Content-Encoding"), captured); ok {
+				captured = decoded
+			}
+		}
+		if cfg.CaptureRedactor != nil {
+			captured = cfg.CaptureRedactor(captured)
+		}
+		d.Response = bytes.NewReader(captured)
+	}
 	return err
 }
 
+// bodyless reports whether res has no body: it answers a HEAD request, or
+// has a status like 304 Not Modified. Its Content-Length, if any, tells the
+// length of the representation the client has or asked about
+func bodyless(res *http.Response) bool {
+	if res.Request != nil && res.Request.Method == http.MethodHead {
+		return true
+	}
+	return res.StatusCode < http.StatusOK || res.StatusCode == http.StatusNoContent || res.StatusCode == http.StatusNotModified
+}
+
+// streaming reports whether res is sent incrementally, like Server-Sent Events,
+// so that its parts must reach the client as soon as they arrive
+func streaming(res *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || res.ContentLength == -1
+}
+
+// clientHeaders applies the header policy of cfg to the headers h of a
+// response to the client, whichever way it's sent
+func clientHeaders(h http.Header, d *Data, cfg *Config) {
+	// header names are canonicalized by Del, so matching is case-insensitive
+	for _, k := range cfg.DropResponseHeaders {
+		h.Del(k)
+	}
+	// don't let an upstream echoing the ID add a second value
+	h.Set(requestIDHeader, d.RequestID)
+	if cfg.CORS != nil {
+		cfg.CORS.allowOrigin(h, d.RequestHeader.Get("Origin"))
+	}
+}
+
+// flushWriter flushes every write through to the client
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	// a compressing writer holds on to its output until flushed too
+	if gz, ok := fw.w.(*gzip.Writer); ok {
+		gz.Flush()
+	}
+	fw.f.Flush()
+	return n, err
+}
+
+// limitedReader reads at most n bytes from r, like io.LimitReader, and tells
+// whether r had more to read
+type limitedReader struct {
+	r         io.Reader
+	n         int64
+	truncated bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		var b [1]byte
+		if n, _ := io.ReadFull(l.r, b[:]); n > 0 {
+			l.truncated = true
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// countingReader counts bytes read through it. The count is kept atomically,
+// as the transport may still be reading a request body after RoundTrip returns
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *countingReader) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// ErrRequestTooLarge is returned for request bodies over Config.MaxRequestBodyBytes
+var ErrRequestTooLarge = errors.New("proxy: request body too large")
+
+// ErrMethodNotAllowed is returned for requests with methods not in
+// Config.AllowedMethods
+var ErrMethodNotAllowed = errors.New("proxy: method not allowed")
+
+// methodAllowed reports whether method is one of allowed, or allowed is empty
+func methodAllowed(method string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, m := range allowed {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// rejection is an error refusing a request on the proxy's own account. The
+// client gets status, but no Data is published for it
+type rejection struct {
+	status int
+	err    error
+	// message, when not empty, is sent to the client instead of the status text
+	message string
+}
+
+func (r *rejection) Error() string { return r.err.Error() }
+
+func (r *rejection) Unwrap() error { return r.err }
+
+// ErrClientTimeout is returned for requests with bodies the client didn't
+// send within Config.ClientReadTimeout
+var ErrClientTimeout = errors.New("proxy: timeout reading request body")
+
+// clientBody records why reading the request body from the client failed.
+// The transport reads it concurrently, hence the lock
+type clientBody struct {
+	r     io.Reader
+	onEOF func()
+
+	mu  sync.Mutex
+	err error
+}
+
+func (c *clientBody) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err == io.EOF && c.onEOF != nil {
+		c.onEOF()
+		c.onEOF = nil
+	}
+	if err != nil && err != io.EOF {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// failed reports whether reading the body from the client failed
+func (c *clientBody) failed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err != nil
+}
+
+// rejection returns the error to refuse the request with, when the client
+// is to blame for the failure to read its body
+func (c *clientBody) rejection() *rejection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var mbe *http.MaxBytesError
+	switch {
+	case errors.As(c.err, &mbe):
+		return &rejection{status: http.StatusRequestEntityTooLarge, err: ErrRequestTooLarge}
+	case errors.Is(c.err, os.ErrDeadlineExceeded):
+		return &rejection{status: http.StatusRequestTimeout, err: ErrClientTimeout}
+	}
+	return nil
+}
+
+// header overriding the request timeout, see Config.MaxTimeoutOverride
+const timeoutHeader = "X-Proxy-Timeout"
+
+// requestTimeout returns the timeout of the upstream exchange for r
+func requestTimeout(r *http.Request, cfg *Config) time.Duration {
+	if cfg.MaxTimeoutOverride > 0 {
+		if t, err := time.ParseDuration(r.Header.Get(timeoutHeader)); err == nil && t > 0 {
+			return min(t, cfg.MaxTimeoutOverride)
+		}
+	}
+	return cfg.RequestTimeout
+}
+
+// delay before the first retry of a failed upstream request, growing linearly
+// with every subsequent attempt
+const retryBackoff = 50 * time.Millisecond
+
+// roundTrip sends req upstream, retrying connection errors when it's safe to do so
+func roundTrip(transport http.RoundTripper, d *Data, req *http.Request, cfg *Config) (*http.Response, error) {
+	waited := false
+	for {
+		res, err := transport.RoundTrip(req)
+		if err == nil && cfg.HonorRetryAfter && !waited {
+			if wait, ok := retryAfterWait(req, res, cfg); ok {
+				waited = true
+				res.Body.Close()
+				d.RetryAfterWait = wait
+				select {
+				case <-time.After(wait):
+					continue
+				case <-req.Context().Done():
+					return nil, req.Context().Err()
+				}
+			}
+		}
+		if err == nil || d.Retries >= cfg.Retries || !retryable(req, err) {
+			return res, err
+		}
+
+		d.Retries++
+		select {
+		case <-time.After(time.Duration(d.Retries) * retryBackoff):
+		case <-req.Context().Done():
+			return nil, err
+		}
+	}
+}
+
+// retryable reports whether req may be sent again after failing with err.
+// Requests with a body can't be replayed, as it has been consumed already,
+// and timeouts are not transient connection failures worth retrying
+func retryable(req *http.Request, err error) bool {
+	if !replayable(req) {
+		return false
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+
+	return req.Context().Err() == nil
+}
+
+// replayable reports whether req may be sent again: its method is idempotent
+// and it has no body, which would have been consumed already
+func replayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// retryAfterWait returns how long to wait before sending req again, when res
+// is a 503 with a Retry-After within Config.MaxRetryAfter
+func retryAfterWait(req *http.Request, res *http.Response, cfg *Config) (time.Duration, bool) {
+	if res.StatusCode != http.StatusServiceUnavailable || !replayable(req) {
+		return 0, false
+	}
+	wait, ok := parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+	if !ok || wait > cfg.orDefault(cfg.MaxRetryAfter) {
+		return 0, false
+	}
+	return wait, true
+}
+
+// parseRetryAfter parses a Retry-After value, either seconds or an HTTP date,
+// into the time to wait from now
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	return max(t.Sub(now), 0), true
+}
+
+// captureBuffer is a bytes.Buffer keeping at most limit bytes written to it.
+// Writes beyond the limit are reported as successful, so that the stream it's
+// teed from is not interrupted, but the data is discarded. Past spill bytes,
+// the capture moves to a temporary file
+type captureBuffer struct {
+	bytes.Buffer
+	limit     int64
+	truncated bool
+	spill     int64
+	file      *os.File
+	size      int64
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.limit > 0 {
+		if room := b.limit - b.size; int64(n) > room {
+			p = p[:room]
+			b.truncated = true
+		}
+	}
+	b.size += int64(len(p))
+	if b.spill > 0 && b.size > b.spill {
+		b.spillToFile()
+	}
+
+	if b.file != nil {
+		// a capture failing to write is cut short, like one over the limit
+		if _, err := b.file.Write(p); err != nil {
+			b.truncated = true
+		}
+		return n, nil
+	}
+	b.Buffer.Write(p)
+	return n, nil
+}
+
+// hop-by-hop headers which must not be forwarded end-to-end, see RFC 7230 section 6.1
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// copyHeaders adds the values of src to the ones of dst. Keys are
+// canonicalized once, rather than for every value as dst.Add would
 func copyHeaders(dst http.Header, src http.Header) {
-	for k := range src {
-		// Do not copy "Connection: close" header, as it makes keep-alives impossible.
-		// For example, Savon sends it with every request
-		if k != "Connection" {
-			dst.Set(k, src.Get(k))
+	for k, vs := range src {
+		if len(vs) == 0 {
+			continue
+		}
+		k = textproto.CanonicalMIMEHeaderKey(k)
+		// copy every value, so that repeated headers like Set-Cookie survive
+		dst[k] = append(dst[k], vs...)
+	}
+}
+
+// removeHopHeaders strips hop-by-hop headers, including the ones listed in
+// the Connection header. Forwarding "Connection: close" would also make
+// keep-alives impossible - for example, Savon sends it with every request
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
 		}
 	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
 }
 
 // prepare new http.Request with the provided URL, and headers+body taken from the origin
 // request
-func prepareRequest(r *http.Request, d *Data, target *url.URL) (*http.Request, error) {
+func prepareRequest(r *http.Request, d *Data, dt *dialTrace, target *url.URL, body io.Reader, cfg *Config) (*http.Request, error) {
 	// parse URL of the incoming request and rewrite it to go to upstream target instead
-	newurl := rewrite(r.URL, target)
-	buf := &bytes.Buffer{}
+	newurl, err := rewrite(r.URL, target, cfg)
+	if err != nil {
+		d.StatusCode = http.StatusNotFound
+		return nil, err
+	}
+	d.UpstreamURL = newurl
 
-	req, err := http.NewRequest(r.Method, newurl, io.TeeReader(r.Body, buf))
-	d.Request = buf
+	// derive from the incoming request context, so that a client going away
+	// aborts the upstream round trip as well
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, newurl, body)
 	if err != nil {
 		return nil, err
 	}
+	// the body is wrapped, so its length is not known from it. Keep the one of
+	// the client, -1 for chunked bodies, unless the transform may change it
+	if body != http.NoBody {
+		req.ContentLength = r.ContentLength
+		if cfg.RequestBodyTransform != nil {
+			req.ContentLength = -1
+		}
+	}
 
-	d.RequestHeader = r.Header
+	d.RequestHeader = r.Header.Clone()
 	copyHeaders(req.Header, r.Header)
+	removeHopHeaders(req.Header)
+
+	// the client sets Host from req.Host, a Host header is never sent as is
+	req.Header.Del("Host")
+	req.Host = target.Host
+	if cfg.PreserveHost {
+		req.Host = r.Host
+	}
+	setForwardedHeaders(req.Header, r)
+	if cfg.ForwardClientCert {
+		setClientCertHeaders(req.Header, r)
+	}
+	req.Header.Set(requestIDHeader, d.RequestID)
+	// meant for the proxy only
+	req.Header.Del(timeoutHeader)
+
+	// an empty User-Agent keeps the client from sending its default one
+	if cfg.UserAgent != "" || req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", cfg.UserAgent)
+	}
+
+	// header names are canonicalized by Del and Set, so matching is case-insensitive
+	if cfg.DisableExpectContinue {
+		req.Header.Del("Expect")
+	}
+	for _, k := range cfg.DropRequestHeaders {
+		req.Header.Del(k)
+	}
+	for k, v := range cfg.SetRequestHeaders {
+		req.Header.Set(k, v)
+	}
+
+	if cfg.ModifyRequest != nil {
+		if err := cfg.ModifyRequest(req); err != nil {
+			return nil, &rejection{status: http.StatusInternalServerError, err: fmt.Errorf("proxy: modify request: %w", err)}
+		}
+		d.UpstreamURL = req.URL.String()
+	}
 
 	trace := &httptrace.ClientTrace{
+		DNSStart:     func(httptrace.DNSStartInfo) { dt.record(&dt.dnsStart, true) },
+		DNSDone:      func(httptrace.DNSDoneInfo) { dt.record(&dt.dnsDone, false) },
+		ConnectStart: func(string, string) { dt.record(&dt.connectStart, true) },
+		ConnectDone:  func(string, string, error) { dt.record(&dt.connectDone, false) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			d.ConnReused = info.Reused
+			d.ConnIdleTime = info.IdleTime
+		},
 		WroteRequest: func(_ httptrace.WroteRequestInfo) {
 			d.Times.WroteRequest = time.Now()
 		},
@@ -146,19 +1195,184 @@ func prepareRequest(r *http.Request, d *Data, target *url.URL) (*http.Request, e
 			d.Times.GotFirstResponseByte = time.Now()
 		},
 	}
-	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	ctx := httptrace.WithClientTrace(req.Context(), trace)
+	if cfg.ProxyProtocol != 0 {
+		ctx = withClientAddrs(ctx, r)
+	}
+	req = req.WithContext(ctx)
 
 	return req, nil
 }
 
+// header carrying the ID of a request across services
+const requestIDHeader = "X-Request-ID"
+
+// newRequestID generates a random request ID
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// crypto/rand doesn't fail on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// setForwardedHeaders lets the upstream know where the request originally came from.
+// The client IP is appended to any existing X-Forwarded-For value, so that chained
+// proxies accumulate correctly
+func setForwardedHeaders(h http.Header, r *http.Request) {
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior, ok := h["X-Forwarded-For"]; ok {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		h.Set("X-Forwarded-For", ip)
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	h.Set("X-Forwarded-Proto", proto)
+	h.Set("X-Forwarded-Host", r.Host)
+}
+
 // parse URL of the incoming request and rewrite it to go to upstream target instead
-func rewrite(source *url.URL, target *url.URL) string {
+func rewrite(source *url.URL, target *url.URL, cfg *Config) (string, error) {
+	path := source.Path
+	if cfg.StripPrefix != "" {
+		if !hasPathPrefix(path, cfg.StripPrefix) {
+			return "", ErrPrefixMismatch
+		}
+		path = strings.TrimPrefix(path, cfg.StripPrefix)
+	}
+	if cfg.AddPrefix != "" {
+		path = joinPath(cfg.AddPrefix, path)
+	}
+	// keep the path prefix of the target URL, e.g. /service of http://backend/service
+	if target.Path != "" {
+		path = joinPath(target.Path, path)
+	}
+	if path == "" {
+		path = "/"
+	}
+
 	u := url.URL{
 		Scheme:   target.Scheme,
 		Host:     target.Host,
-		Path:     source.Path,
+		Path:     path,
 		RawQuery: source.RawQuery,
 	}
 
-	return u.String()
+	return u.String(), nil
+}
+
+// ErrAmbiguousLength is returned for requests, with 400, and upstream
+// responses, with 502, whose length is framed in conflicting ways, which
+// smuggling attacks rely on
+var ErrAmbiguousLength = errors.New("proxy: ambiguous message length")
+
+// ambiguousLength reports whether a message with header h and
+// transferEncoding has both a Content-Length and chunked encoding, or
+// several differing Content-Length values. The HTTP server and transport of
+// net/http already refuse the latter and drop Content-Length from the
+// former, so this guards messages of custom transports and handler chains
+func ambiguousLength(h http.Header, transferEncoding []string) bool {
+	lengths := h.Values("Content-Length")
+	if len(lengths) == 0 {
+		return false
+	}
+	for _, v := range lengths[1:] {
+		if strings.TrimSpace(v) != strings.TrimSpace(lengths[0]) {
+			return true
+		}
+	}
+	return chunked(transferEncoding) || chunked(h.Values("Transfer-Encoding"))
+}
+
+// chunked reports whether the transfer codings include chunked
+func chunked(codings []string) bool {
+	for _, v := range codings {
+		for _, coding := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(coding), "chunked") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ErrPathNotAllowed is returned for requests with paths not matching
+// Config.PathAllowlist
+var ErrPathNotAllowed = errors.New("proxy: path not allowed")
+
+// ErrDotSegments is returned for requests with . or .. segments in their
+// path, which would slip past Config.PathAllowlist, Config.SchemaPaths and
+// routes
+var ErrDotSegments = errors.New("proxy: dot segments in request path")
+
+// dotSegments reports whether p has . or .. segments. p is the decoded path,
+// so that escaped dots, like %2e%2e, are found as well
+func dotSegments(p string) bool {
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "." || seg == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// pathAllowed reports whether p matches one of the patterns in allowed, or
+// allowed is empty. Patterns with wildcards are matched with path.Match, the
+// others as prefixes
+func pathAllowed(p string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, pattern := range allowed {
+		if pathMatches(p, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathMatches reports whether p matches pattern, with path.Match when it has
+// wildcards, and as a prefix otherwise
+func pathMatches(p, pattern string) bool {
+	if glob(pattern) {
+		ok, _ := path.Match(pattern, p)
+		return ok
+	}
+	return hasPathPrefix(p, pattern)
+}
+
+// glob reports whether pattern has any of the wildcards of path.Match
+func glob(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// ErrPrefixMismatch is reported in Data.Error when the request path doesn't
+// start with Config.StripPrefix
+var ErrPrefixMismatch = errors.New("proxy: request path does not match the stripped prefix")
+
+// hasPathPrefix reports whether path starts with prefix on a segment boundary,
+// so that /api matches /api and /api/users, but not /apis
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// joinPath joins two URL paths with exactly one slash between them
+func joinPath(a, b string) string {
+	switch {
+	case b == "":
+		return a
+	case strings.HasSuffix(a, "/") && strings.HasPrefix(b, "/"):
+		return a + b[1:]
+	case !strings.HasSuffix(a, "/") && !strings.HasPrefix(b, "/"):
+		return a + "/" + b
+	}
+	return a + b
 }
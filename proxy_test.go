@@ -1,11 +1,23 @@
 package proxy_test
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -50,7 +62,12 @@ var responseHeaders = map[string]string{
 }
 
 func sendRequest(t *testing.T, target *httptest.Server, mchan chan proxy.Data) *http.Response {
-	h, err := proxy.NewHandler(target.URL, timeout, mchan)
+	cb := func(status int, err error) {}
+	return sendRequestWithCallback(t, target, mchan, cb)
+}
+
+func sendRequestWithCallback(t *testing.T, target *httptest.Server, mchan chan proxy.Data, cb func(int, error)) *http.Response {
+	h, err := proxy.NewHandler(target.URL, timeout, mchan, cb)
 	require.NoError(t, err)
 
 	prx := httptest.NewServer(h)
@@ -72,6 +89,30 @@ func sendRequest(t *testing.T, target *httptest.Server, mchan chan proxy.Data) *
 	return res
 }
 
+// send a request with the given headers through a proxy server running h.
+// POST requests carry requestBody, other methods are sent without a body
+func doRequest(t *testing.T, h http.Handler, method string, headers map[string]string) *http.Response {
+	prx := httptest.NewServer(h)
+	defer prx.Close()
+
+	var body io.Reader
+	if method == http.MethodPost {
+		body = strings.NewReader(requestBody)
+	}
+
+	req, err := http.NewRequest(method, prx.URL+"/some/path", body)
+	require.NoError(t, err)
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := prx.Client().Do(req)
+	require.NoError(t, err)
+
+	return res
+}
+
 func TestSuccessfulRequestProxying(t *testing.T) {
 	mchan := make(chan proxy.Data, 10)
 
@@ -98,6 +139,9 @@ func TestSuccessfulRequestProxying(t *testing.T) {
 		repResponse, err := ioutil.ReadAll(data.Response)
 		require.NoError(t, err)
 		require.Equal(t, responseBody, string(repResponse), "reported response must match")
+
+		validateHeaders(t, data.RequestHeader, requestHeaders)
+		validateHeaders(t, data.ResponseHeader, responseHeaders)
 	default:
 		require.Fail(t, "Proxy must have published a data item")
 	}
@@ -135,12 +179,14 @@ func TestBrokenUpstreamConnection(t *testing.T) {
 
 	res := sendRequest(t, target, mchan)
 
-	require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	require.Equal(t, http.StatusBadGateway, res.StatusCode)
 
 	select {
 	case data := <-mchan:
-		require.Equal(t, http.StatusServiceUnavailable, data.StatusCode, "Published status must be 503")
+		require.Equal(t, http.StatusBadGateway, data.StatusCode, "Published status must be 502")
+		require.Error(t, data.Error)
 	default:
+		require.Fail(t, "Proxy must have published a data item for the failure")
 	}
 }
 
@@ -160,13 +206,1972 @@ func TestUpstreamTimeout(t *testing.T) {
 
 	res := sendRequest(t, target, mchan)
 	stop <- true
-	require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	require.Equal(t, http.StatusGatewayTimeout, res.StatusCode)
+
+	target.Close()
+	select {
+	case data := <-mchan:
+		require.Equal(t, http.StatusGatewayTimeout, data.StatusCode, "Published status must be 504")
+		require.Error(t, data.Error)
+	default:
+		require.Fail(t, "Proxy must have published a data item for the failure")
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:             target.URL,
+		Timeout:               timeout,
+		ResponseHeaderTimeout: 100 * time.Millisecond,
+		DataChan:              mchan,
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusGatewayTimeout, w.Code)
+
+	data := <-mchan
+	require.ErrorContains(t, data.Error, "timeout awaiting response headers")
+	require.Less(t, data.Times.Total(), timeout)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// headers and a part of the body arrive in time, the rest does not
+		w.Header().Set("Content-Length", "20000")
+		w.Write([]byte(strings.Repeat("x", 10000)))
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(2 * timeout):
+		case <-r.Context().Done():
+		}
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:      target.URL,
+		Timeout:        timeout,
+		RequestTimeout: 100 * time.Millisecond,
+		DataChan:       mchan,
+	})
+	require.NoError(t, err)
+
+	prx := httptest.NewServer(h)
+	defer prx.Close()
+
+	res, err := prx.Client().Get(prx.URL)
+	require.NoError(t, err)
+	_, err = io.ReadAll(res.Body)
+	res.Body.Close()
+	require.Error(t, err)
+
+	data := <-mchan
+	require.True(t, data.ResponseInterrupted)
+	require.ErrorIs(t, data.Error, context.DeadlineExceeded)
+	require.Less(t, data.Times.Total(), timeout)
+}
+
+func TestRequestTimeoutBeforeResponse(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// respond later than the request may take
+		select {
+		case <-time.After(2 * timeout):
+		case <-r.Context().Done():
+		}
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:      target.URL,
+		Timeout:        timeout,
+		RequestTimeout: 100 * time.Millisecond,
+		DataChan:       mchan,
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusGatewayTimeout, w.Code)
+
+	data := <-mchan
+	require.Equal(t, http.StatusGatewayTimeout, data.StatusCode)
+	require.ErrorIs(t, data.Error, context.DeadlineExceeded)
+	require.Less(t, data.Times.Total(), timeout)
+}
 
-	// verify that data message has not been published
+func TestCompletionCallback(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+
+	var calls int
+	var status int
+	var cbErr error
+	cb := func(s int, err error) {
+		calls++
+		status = s
+		cbErr = err
+	}
+
+	res := sendRequestWithCallback(t, target, mchan, cb)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, 1, calls, "callback must fire once per request")
+	require.Equal(t, http.StatusOK, status)
+	require.NoError(t, cbErr)
+
+	// callback must fire on the upstream failure path too
 	target.Close()
+	calls = 0
+
+	res = sendRequestWithCallback(t, target, mchan, cb)
+	require.Equal(t, http.StatusBadGateway, res.StatusCode)
+	require.Equal(t, 1, calls, "callback must fire once per request")
+	require.Equal(t, http.StatusBadGateway, status)
+	require.Error(t, cbErr)
+}
+
+func TestMultiValueResponseHeaders(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc")
+		w.Header().Add("Set-Cookie", "csrf=xyz")
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	res := sendRequest(t, target, mchan)
+
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, []string{"session=abc", "csrf=xyz"}, res.Header["Set-Cookie"])
+}
+
+func TestHopByHopHeadersStripped(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Empty(t, r.Header.Get("Connection"))
+		require.Empty(t, r.Header.Get("X-Custom"))
+		require.Empty(t, r.Header.Get("Proxy-Authorization"))
+		validateHeaders(t, r.Header, requestHeaders)
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandler(target.URL, timeout, mchan, nil)
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodPost, map[string]string{
+		"Content-Type":        "text/xml",
+		"X-Request-Header":    "request header value",
+		"Connection":          "X-Custom",
+		"X-Custom":            "hop value",
+		"Proxy-Authorization": "Basic Zm9vOmJhcg==",
+	})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	validateBody(t, res.Body, responseBody)
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	var forwardedFor, forwardedProto, forwardedHost string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor = r.Header.Get("X-Forwarded-For")
+		forwardedProto = r.Header.Get("X-Forwarded-Proto")
+		forwardedHost = r.Header.Get("X-Forwarded-Host")
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandler(target.URL, timeout, mchan, nil)
+	require.NoError(t, err)
+
+	doRequest(t, h, http.MethodPost, requestHeaders)
+	require.Equal(t, "127.0.0.1", forwardedFor)
+	require.Equal(t, "http", forwardedProto)
+	require.Contains(t, forwardedHost, "127.0.0.1:")
+
+	// chained proxies accumulate
+	doRequest(t, h, http.MethodPost, map[string]string{"X-Forwarded-For": "10.0.0.1"})
+	require.Equal(t, "10.0.0.1, 127.0.0.1", forwardedFor)
+}
+
+func TestMaxCaptureBytes(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+	largeBody := strings.Repeat("0123456789", 1000)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validateBody(t, r.Body, requestBody)
+		writeResponse(w, largeBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandler(target.URL, timeout, mchan, nil, proxy.WithMaxCaptureBytes(5))
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodPost, requestHeaders)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	validateBody(t, res.Body, largeBody)
+
 	select {
 	case data := <-mchan:
-		require.Equal(t, http.StatusServiceUnavailable, data.StatusCode, "Published status must be 503")
+		repRequest, err := ioutil.ReadAll(data.Request)
+		require.NoError(t, err)
+		require.Equal(t, requestBody[:5], string(repRequest))
+		require.True(t, data.RequestCaptureTruncated)
+
+		repResponse, err := ioutil.ReadAll(data.Response)
+		require.NoError(t, err)
+		require.Equal(t, largeBody[:5], string(repResponse))
+		require.True(t, data.ResponseCaptureTruncated)
 	default:
+		require.Fail(t, "Proxy must have published a data item")
+	}
+}
+
+func TestFullDataChannelDoesNotBlock(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandler(target.URL, timeout, mchan, nil)
+	require.NoError(t, err)
+
+	before := proxy.Dropped()
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		res := doRequest(t, h, http.MethodPost, requestHeaders)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.True(t, time.Since(start) < timeout, "request must not wait for the consumer")
+	}
+
+	require.Len(t, mchan, 1)
+	require.Equal(t, uint64(2), proxy.Dropped()-before)
+}
+
+// flakyListener drops the first fails accepted connections without a response
+type flakyListener struct {
+	net.Listener
+	fails int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || atomic.AddInt32(&l.fails, -1) < 0 {
+			return conn, err
+		}
+		conn.Close()
+	}
+}
+
+func newFlakyServer(fails int32) *httptest.Server {
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	target.Listener = &flakyListener{Listener: target.Listener, fails: fails}
+	target.Start()
+
+	return target
+}
+
+func TestRetryRecoveringUpstream(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	target := newFlakyServer(2)
+	defer target.Close()
+
+	h, err := proxy.NewHandler(target.URL, timeout, mchan, nil, proxy.WithRetries(3))
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodGet, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	validateBody(t, res.Body, responseBody)
+
+	data := <-mchan
+	require.Equal(t, 2, data.Retries)
+}
+
+func TestRetryDownUpstream(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	target.Close()
+
+	h, err := proxy.NewHandler(target.URL, timeout, mchan, nil, proxy.WithRetries(2))
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodGet, nil)
+	require.Equal(t, http.StatusBadGateway, res.StatusCode)
+
+	data := <-mchan
+	require.Equal(t, 2, data.Retries)
+}
+
+func TestNoRetryForNonIdempotentMethods(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	target := newFlakyServer(1)
+	defer target.Close()
+
+	h, err := proxy.NewHandler(target.URL, timeout, mchan, nil, proxy.WithRetries(3))
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodPost, requestHeaders)
+	require.Equal(t, http.StatusBadGateway, res.StatusCode)
+
+	data := <-mchan
+	require.Equal(t, 0, data.Retries)
+}
+
+func TestClientCancellationPropagates(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+	cancelled := make(chan bool, 1)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- true
+		case <-time.After(2 * timeout):
+			cancelled <- false
+		}
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandler(target.URL, 3*timeout, mchan, nil)
+	require.NoError(t, err)
+
+	prx := httptest.NewServer(h)
+	defer prx.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, prx.URL+"/some/path", nil)
+	require.NoError(t, err)
+
+	_, err = prx.Client().Do(req)
+	require.Error(t, err)
+
+	select {
+	case ok := <-cancelled:
+		require.True(t, ok, "upstream must observe the cancellation")
+	case <-time.After(timeout):
+		require.Fail(t, "upstream didn't observe the cancellation in time")
+	}
+}
+
+func TestPathPrefixRewrite(t *testing.T) {
+	var upstreamURL string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamURL = r.URL.String()
+	}))
+	defer target.Close()
+
+	cases := []struct {
+		name        string
+		strip, add  string
+		path        string
+		status      int
+		upstreamURL string
+	}{
+		{"strip only", "/api/v1", "", "/api/v1/users?id=1", http.StatusOK, "/users?id=1"},
+		{"strip whole path", "/api/v1", "", "/api/v1", http.StatusOK, "/"},
+		{"add only", "", "/backend", "/users?id=1", http.StatusOK, "/backend/users?id=1"},
+		{"strip and add", "/api/v1", "/backend/", "/api/v1/users", http.StatusOK, "/backend/users"},
+		{"non-matching", "/api/v1", "", "/other/users", http.StatusNotFound, ""},
+		{"partial segment", "/api/v1", "", "/api/v10/users", http.StatusNotFound, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			upstreamURL = ""
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL:   target.URL,
+				Timeout:     timeout,
+				StripPrefix: c.strip,
+				AddPrefix:   c.add,
+			})
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodGet, c.path, nil))
+
+			require.Equal(t, c.status, w.Code)
+			require.Equal(t, c.upstreamURL, upstreamURL)
+		})
+	}
+}
+
+func TestTargetPathPrefix(t *testing.T) {
+	var upstreamPath string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+	}))
+	defer target.Close()
+
+	cases := []struct {
+		name         string
+		targetPath   string
+		path         string
+		upstreamPath string
+	}{
+		{"no target path", "", "/foo", "/foo"},
+		{"target path", "/service", "/foo", "/service/foo"},
+		{"target path with trailing slash", "/service/", "/foo", "/service/foo"},
+		{"incoming path without leading slash", "/service", "foo", "/service/foo"},
+		{"both without slashes", "/service/", "foo", "/service/foo"},
+		{"root incoming path", "/service", "/", "/service/"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			upstreamPath = ""
+			h, err := proxy.NewHandler(target.URL+c.targetPath, timeout, nil, nil)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.URL.Path = c.path
+
+			w := httptest.NewRecorder()
+			h(w, req)
+
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, c.upstreamPath, upstreamPath)
+		})
+	}
+}
+
+func TestCaptureDisabled(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validateBody(t, r.Body, requestBody)
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL: target.URL,
+		Timeout:   timeout,
+		DataChan:  mchan,
+	})
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodPost, requestHeaders)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	validateBody(t, res.Body, responseBody)
+
+	data := <-mchan
+	require.Nil(t, data.Request)
+	require.Nil(t, data.Response)
+}
+
+func BenchmarkCapture(b *testing.B) {
+	largeBody := strings.Repeat("0123456789", 100000)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, largeBody)
+	}))
+	defer target.Close()
+
+	for _, capture := range []bool{true, false} {
+		b.Run(fmt.Sprintf("capture=%t", capture), func(b *testing.B) {
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL:       target.URL,
+				Timeout:         timeout,
+				CaptureRequest:  capture,
+				CaptureResponse: capture,
+			})
+			require.NoError(b, err)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			}
+		})
 	}
 }
+
+func BenchmarkHeaders(b *testing.B) {
+	header := http.Header{
+		"Content-Type":    {"application/json; charset=utf-8"},
+		"Cache-Control":   {"private, max-age=0"},
+		"Date":            {"Tue, 01 Jan 2019 00:00:00 GMT"},
+		"Etag":            {`"33a64df551425fcc55e4d42a148795d9f25f89d4"`},
+		"Server":          {"nginx"},
+		"Set-Cookie":      {"session=38afes7a8; Path=/; HttpOnly", "theme=dark; Path=/", "lang=en; Path=/"},
+		"Vary":            {"Accept-Encoding", "Origin"},
+		"X-Frame-Options": {"DENY"},
+	}
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL: "http://upstream",
+		Timeout:   timeout,
+		LogFormat: proxy.LogNone,
+		Transport: funcTransport(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Header: header.Clone(), Body: http.NoBody, Request: req}, nil
+		}),
+	})
+	require.NoError(b, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header = http.Header{
+		"Accept":          {"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+		"Accept-Encoding": {"gzip, deflate, br"},
+		"Accept-Language": {"en-US,en;q=0.5"},
+		"Authorization":   {"Bearer eyJhbGciOiJIUzI1NiJ9.e30.ZRrHA1JJJW8opsbCGfG_HACGpVUMN_a9IV7pAx_Zmeo"},
+		"Cookie":          {"session=38afes7a8; theme=dark; lang=en"},
+		"Referer":         {"https://example.com/"},
+		"User-Agent":      {"Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0"},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h(httptest.NewRecorder(), req)
+	}
+}
+
+// copyHeadersAdd is copyHeaders as it was before, adding value by value, as
+// the baseline of BenchmarkCopyHeaders
+func copyHeadersAdd(dst http.Header, src http.Header) {
+	for k, vs := range src {
+		for _, v := range vs {
+			dst.Add(k, v)
+		}
+	}
+}
+
+func BenchmarkCopyHeaders(b *testing.B) {
+	src := http.Header{
+		"Content-Type":    {"application/json; charset=utf-8"},
+		"Cache-Control":   {"private, max-age=0"},
+		"Date":            {"Tue, 01 Jan 2019 00:00:00 GMT"},
+		"Etag":            {`"33a64df551425fcc55e4d42a148795d9f25f89d4"`},
+		"Server":          {"nginx"},
+		"Set-Cookie":      {"session=38afes7a8; Path=/; HttpOnly", "theme=dark; Path=/", "lang=en; Path=/"},
+		"Vary":            {"Accept-Encoding", "Origin"},
+		"X-Frame-Options": {"DENY"},
+	}
+
+	for name, copyHeaders := range map[string]func(dst, src http.Header){
+		"add":    copyHeadersAdd,
+		"append": proxy.CopyHeaders,
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				copyHeaders(make(http.Header, len(src)), src)
+			}
+		})
+	}
+}
+
+func TestInterruptedResponse(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// large enough for the proxy to start sending the response to the client
+		w.Header().Set("Content-Length", "20000")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, strings.Repeat("0123456789", 1000))
+		w.(http.Flusher).Flush()
+
+		// drop the connection before the promised body is sent
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		conn.Close()
+	}))
+	defer target.Close()
+
+	var cbStatus int
+	h, err := proxy.NewHandler(target.URL, timeout, mchan, func(status int, err error) { cbStatus = status })
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodGet, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	_, err = ioutil.ReadAll(res.Body)
+	require.Error(t, err, "client must not get a seemingly complete response")
+
+	data := <-mchan
+	require.True(t, data.ResponseInterrupted)
+	require.Error(t, data.Error)
+	require.Equal(t, http.StatusOK, data.StatusCode, "the status sent to the client must be reported")
+	require.Equal(t, http.StatusOK, cbStatus)
+}
+
+func TestBodySizes(t *testing.T) {
+	for _, capture := range []bool{true, false} {
+		t.Run(fmt.Sprintf("capture=%t", capture), func(t *testing.T) {
+			mchan := make(chan proxy.Data, 10)
+
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				validateBody(t, r.Body, requestBody)
+				writeResponse(w, responseBody, responseHeaders)
+			}))
+			defer target.Close()
+
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL:       target.URL,
+				Timeout:         timeout,
+				DataChan:        mchan,
+				CaptureRequest:  capture,
+				CaptureResponse: capture,
+			})
+			require.NoError(t, err)
+
+			res := doRequest(t, h, http.MethodPost, requestHeaders)
+			require.Equal(t, http.StatusOK, res.StatusCode)
+
+			data := <-mchan
+			require.Equal(t, int64(len(requestBody)), data.RequestBytes)
+			require.Equal(t, int64(len(responseBody)), data.ResponseBytes)
+		})
+	}
+}
+
+func TestDropAndSetRequestHeaders(t *testing.T) {
+	var upstreamHeader http.Header
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:          target.URL,
+		Timeout:            timeout,
+		DropRequestHeaders: []string{"cookie", "AUTHORIZATION"},
+		SetRequestHeaders:  map[string]string{"x-api-key": "secret", "X-Request-Header": "forced"},
+	})
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodPost, map[string]string{
+		"Cookie":           "session=abc",
+		"Authorization":    "Bearer token",
+		"X-Request-Header": "client value",
+		"Content-Type":     "text/xml",
+	})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	require.Empty(t, upstreamHeader.Get("Cookie"))
+	require.Empty(t, upstreamHeader.Get("Authorization"))
+	require.Equal(t, "secret", upstreamHeader.Get("X-Api-Key"))
+	require.Equal(t, []string{"forced"}, upstreamHeader["X-Request-Header"])
+	require.Equal(t, "text/xml", upstreamHeader.Get("Content-Type"))
+}
+
+func TestUpstreamHost(t *testing.T) {
+	var host string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	defer target.Close()
+
+	for expected, preserve := range map[string]bool{"public.example.com": true, target.Listener.Addr().String(): false} {
+		h, err := proxy.NewHandlerWithConfig(proxy.Config{
+			TargetURL:    target.URL,
+			Timeout:      timeout,
+			PreserveHost: preserve,
+		})
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "http://public.example.com/some/path", nil)
+		w := httptest.NewRecorder()
+		h(w, req)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, expected, host)
+	}
+}
+
+func TestMaxRequestBodyBytes(t *testing.T) {
+	const limit = 16
+	for _, tc := range []struct {
+		name    string
+		size    int
+		chunked bool
+		status  int
+	}{
+		{"under", limit - 1, false, http.StatusOK},
+		{"at", limit, false, http.StatusOK},
+		{"over", limit + 1, false, http.StatusRequestEntityTooLarge},
+		{"chunked under", limit - 1, true, http.StatusOK},
+		{"chunked at", limit, true, http.StatusOK},
+		{"chunked over", 4 * limit, true, http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mchan := make(chan proxy.Data, 10)
+
+			var called bool
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				io.Copy(io.Discard, r.Body)
+			}))
+			defer target.Close()
+
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL:           target.URL,
+				Timeout:             timeout,
+				DataChan:            mchan,
+				MaxRequestBodyBytes: limit,
+			})
+			require.NoError(t, err)
+
+			prx := httptest.NewServer(h)
+			defer prx.Close()
+
+			var body io.Reader = strings.NewReader(strings.Repeat("x", tc.size))
+			if tc.chunked {
+				// hide the length from the client, so that it sends the body chunked
+				body = io.MultiReader(body)
+			}
+			res, err := prx.Client().Post(prx.URL, "text/plain", body)
+			require.NoError(t, err)
+			res.Body.Close()
+
+			require.Equal(t, tc.status, res.StatusCode)
+			if tc.status == http.StatusOK {
+				require.Len(t, mchan, 1)
+				require.Equal(t, int64(tc.size), (<-mchan).RequestBytes)
+			} else {
+				require.Len(t, mchan, 0)
+				if !tc.chunked {
+					require.False(t, called)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var upstreamID string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get("X-Request-ID")
+		// an upstream echoing the ID must not duplicate it
+		w.Header().Set("X-Request-ID", upstreamID)
+	}))
+	defer target.Close()
+
+	for name, incoming := range map[string]string{"generate": "", "propagate": "abc-123"} {
+		t.Run(name, func(t *testing.T) {
+			mchan := make(chan proxy.Data, 1)
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL: target.URL,
+				Timeout:   timeout,
+				DataChan:  mchan,
+			})
+			require.NoError(t, err)
+
+			headers := map[string]string{}
+			if incoming != "" {
+				headers["X-Request-ID"] = incoming
+			}
+			res := doRequest(t, h, http.MethodGet, headers)
+			require.Equal(t, http.StatusOK, res.StatusCode)
+
+			data := <-mchan
+			require.NotEmpty(t, data.RequestID)
+			if incoming != "" {
+				require.Equal(t, incoming, data.RequestID)
+			}
+			require.Equal(t, data.RequestID, upstreamID)
+			require.Equal(t, []string{data.RequestID}, res.Header.Values("X-Request-ID"))
+		})
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	refused := "http://" + l.Addr().String()
+	l.Close()
+
+	t.Run("default", func(t *testing.T) {
+		h, err := proxy.NewHandlerWithConfig(proxy.Config{TargetURL: refused, Timeout: timeout})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusBadGateway, w.Code)
+		require.Equal(t, "Bad Gateway\n", w.Body.String(), "error details must not leak")
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		var handled error
+		h, err := proxy.NewHandlerWithConfig(proxy.Config{
+			TargetURL: refused,
+			Timeout:   timeout,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				handled = err
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadGateway)
+				w.Write([]byte(`{"error":"upstream unavailable"}`))
+			},
+		})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Error(t, handled)
+		require.Equal(t, http.StatusBadGateway, w.Code)
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		require.Equal(t, `{"error":"upstream unavailable"}`, w.Body.String())
+	})
+}
+
+func TestStatusRewriter(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL: target.URL,
+		Timeout:   timeout,
+		DataChan:  mchan,
+		StatusRewriter: func(status int) int {
+			if status == http.StatusInternalServerError {
+				return http.StatusBadGateway
+			}
+			return status
+		},
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusBadGateway, w.Code)
+
+	data := <-mchan
+	require.Equal(t, http.StatusInternalServerError, data.StatusCode)
+	require.Equal(t, http.StatusBadGateway, data.ClientStatusCode)
+}
+
+func TestStreamingResponse(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: event %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(delay)
+		}
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandler(target.URL, timeout, make(chan proxy.Data, 1), nil)
+	require.NoError(t, err)
+
+	prx := httptest.NewServer(h)
+	defer prx.Close()
+
+	start := time.Now()
+	res, err := prx.Client().Get(prx.URL)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	// every event must arrive about when it was sent, not all at the end
+	scanner := bufio.NewScanner(res.Body)
+	for i := 0; i < 3; i++ {
+		require.True(t, scanner.Scan())
+		require.Equal(t, fmt.Sprintf("data: event %d", i), scanner.Text())
+		require.Less(t, time.Since(start), time.Duration(i+1)*delay)
+		require.True(t, scanner.Scan())
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:      target.URL,
+		Timeout:        timeout,
+		DataChan:       mchan,
+		AllowedMethods: []string{http.MethodGet, http.MethodHead},
+	})
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodGet, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	validateBody(t, res.Body, responseBody)
+	require.Len(t, mchan, 1)
+	<-mchan
+
+	res = doRequest(t, h, http.MethodPost, nil)
+	require.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	require.Equal(t, "GET, HEAD", res.Header.Get("Allow"))
+	require.Len(t, mchan, 0, "rejected requests must not be published")
+}
+
+func TestPathAllowlist(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:     target.URL,
+		Timeout:       timeout,
+		DataChan:      mchan,
+		PathAllowlist: []string{"/api", "/static/*.css"},
+	})
+	require.NoError(t, err)
+
+	cases := map[string]int{
+		"/api":             http.StatusOK,
+		"/api/users":       http.StatusOK,
+		"/apis":            http.StatusNotFound,
+		"/static/site.css": http.StatusOK,
+		"/static/site.js":  http.StatusNotFound,
+		"/static/a/b.css":  http.StatusNotFound,
+		"/admin":           http.StatusNotFound,
+		// the upstream would see /admin
+		"/api/../admin":     http.StatusBadRequest,
+		"/api/%2e%2e/admin": http.StatusBadRequest,
+		"/api/%2E./admin":   http.StatusBadRequest,
+		"/api/./users":      http.StatusBadRequest,
+	}
+	for path, status := range cases {
+		t.Run(path, func(t *testing.T) {
+			before := atomic.LoadInt32(&hits)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			require.Equal(t, status, rec.Code)
+			if status == http.StatusOK {
+				require.Equal(t, before+1, atomic.LoadInt32(&hits))
+				require.Len(t, mchan, 1)
+				<-mchan
+			} else {
+				require.Equal(t, before, atomic.LoadInt32(&hits), "the upstream must not be contacted")
+				require.Len(t, mchan, 0, "rejected requests must not be published")
+			}
+		})
+	}
+}
+
+func TestRequestBodyTransform(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validateBody(t, r.Body, strings.ToUpper(requestBody))
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:      target.URL,
+		Timeout:        timeout,
+		DataChan:       mchan,
+		CaptureRequest: true,
+		RequestBodyTransform: func(body io.Reader) (io.Reader, error) {
+			b, err := io.ReadAll(body)
+			if err != nil {
+				return nil, err
+			}
+			return bytes.NewReader(bytes.ToUpper(b)), nil
+		},
+	})
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodPost, requestHeaders)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	data := <-mchan
+	captured, err := io.ReadAll(data.Request)
+	require.NoError(t, err)
+	require.Equal(t, strings.ToUpper(requestBody), string(captured))
+}
+
+func TestResponseBodyTransform(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := `<a href="http://internal/page">link</a>`
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write([]byte(body))
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:       target.URL,
+		Timeout:         timeout,
+		DataChan:        mchan,
+		CaptureResponse: true,
+		ResponseBodyTransform: func(body io.Reader) (io.Reader, error) {
+			b, err := io.ReadAll(body)
+			if err != nil {
+				return nil, err
+			}
+			return bytes.NewReader(bytes.ReplaceAll(b, []byte("http://internal"), []byte("https://public"))), nil
+		},
+	})
+	require.NoError(t, err)
+
+	expected := `<a href="https://public/page">link</a>`
+	res := doRequest(t, h, http.MethodGet, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	validateBody(t, res.Body, expected)
+
+	data := <-mchan
+	captured, err := io.ReadAll(data.Response)
+	require.NoError(t, err)
+	require.Equal(t, expected, string(captured))
+}
+
+func TestTrailers(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte(responseBody))
+		w.Header().Set("Grpc-Status", "0")
+		// undeclared trailers are only known once the handler returns
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandler(target.URL, timeout, make(chan proxy.Data, 1), nil)
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodGet, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	validateBody(t, res.Body, responseBody)
+	require.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+	require.Equal(t, "ok", res.Trailer.Get("Grpc-Message"))
+}
+
+func TestUserAgent(t *testing.T) {
+	var userAgent []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Values("User-Agent")
+	}))
+	defer target.Close()
+
+	cases := map[string]struct {
+		configured string
+		client     string
+		expected   []string
+	}{
+		"override":    {"redstar-proxy/1.0", "curl/8.0", []string{"redstar-proxy/1.0"}},
+		"passthrough": {"", "curl/8.0", []string{"curl/8.0"}},
+		"suppression": {"", "", nil},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL: target.URL,
+				Timeout:   timeout,
+				UserAgent: tc.configured,
+			})
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.client != "" {
+				req.Header.Set("User-Agent", tc.client)
+			}
+			h(httptest.NewRecorder(), req)
+
+			require.Equal(t, tc.expected, userAgent)
+		})
+	}
+}
+
+func TestClientReadTimeout(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:         target.URL,
+		Timeout:           timeout,
+		DataChan:          mchan,
+		ClientReadTimeout: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	prx := httptest.NewServer(h)
+	defer prx.Close()
+
+	// the client sends a part of the body, then stalls
+	body, stall := io.Pipe()
+	defer stall.Close()
+	go stall.Write([]byte("partial"))
+
+	res, err := prx.Client().Post(prx.URL, "text/plain", body)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	require.Equal(t, http.StatusRequestTimeout, res.StatusCode)
+	require.Len(t, mchan, 0, "timed out requests must not be published")
+}
+
+func TestClientReadTimeoutSlowUpstream(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:         target.URL,
+		Timeout:           timeout,
+		ClientReadTimeout: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	// a body read in time must not cut the wait for the upstream short
+	res := doRequest(t, h, http.MethodPost, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestUnixSocketUpstream(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/some/path", r.URL.Path)
+		validateBody(t, r.Body, requestBody)
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	target.Listener = l
+	target.Start()
+	defer target.Close()
+
+	h, err := proxy.NewHandler("unix://"+socket, timeout, mchan, nil)
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodPost, requestHeaders)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	validateBody(t, res.Body, responseBody)
+	require.Equal(t, "unix:"+socket, (<-mchan).Upstream)
+}
+
+func TestTimeoutOverride(t *testing.T) {
+	var forwarded int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Proxy-Timeout") != "" {
+			atomic.AddInt32(&forwarded, 1)
+		}
+		time.Sleep(150 * time.Millisecond)
+	}))
+	defer target.Close()
+
+	cases := map[string]struct {
+		header  string
+		timeout time.Duration
+		status  int
+	}{
+		"absent":   {"", 100 * time.Millisecond, http.StatusGatewayTimeout},
+		"valid":    {"300ms", 300 * time.Millisecond, http.StatusOK},
+		"over max": {"1h", 500 * time.Millisecond, http.StatusOK},
+		"too low":  {"50ms", 50 * time.Millisecond, http.StatusGatewayTimeout},
+		"invalid":  {"soon", 100 * time.Millisecond, http.StatusGatewayTimeout},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			mchan := make(chan proxy.Data, 1)
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL:          target.URL,
+				Timeout:            timeout,
+				DataChan:           mchan,
+				RequestTimeout:     100 * time.Millisecond,
+				MaxTimeoutOverride: 500 * time.Millisecond,
+			})
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.header != "" {
+				req.Header.Set("X-Proxy-Timeout", tc.header)
+			}
+			w := httptest.NewRecorder()
+			h(w, req)
+
+			require.Equal(t, tc.status, w.Code)
+			require.Equal(t, tc.timeout, (<-mchan).Timeout)
+		})
+	}
+	require.Zero(t, atomic.LoadInt32(&forwarded), "the header must not be forwarded")
+}
+
+func TestConnReuse(t *testing.T) {
+	mchan := make(chan proxy.Data, 2)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, responseBody, nil)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandler(target.URL, timeout, mchan, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	first := <-mchan
+	require.False(t, first.ConnReused)
+	require.Zero(t, first.ConnIdleTime)
+
+	second := <-mchan
+	require.True(t, second.ConnReused)
+	require.Greater(t, second.ConnIdleTime, time.Duration(0))
+}
+
+func TestCaptureSample(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	largeBody := strings.Repeat("0123456789abcdef", 1<<16)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, largeBody, nil)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:          target.URL,
+		Timeout:            timeout,
+		DataChan:           mchan,
+		CaptureSampleBytes: 256,
+	})
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodGet, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	validateBody(t, res.Body, largeBody)
+
+	data := <-mchan
+	require.NotNil(t, data.Response)
+	sample, err := io.ReadAll(data.Response)
+	require.NoError(t, err)
+	require.Equal(t, largeBody[:256], string(sample))
+	require.True(t, data.ResponseCaptureTruncated)
+	require.Equal(t, int64(len(largeBody)), data.ResponseBytes)
+}
+
+func TestDropResponseHeaders(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "internal/1.2.3")
+		w.Header().Set("X-Powered-By", "internals")
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:           target.URL,
+		Timeout:             timeout,
+		DataChan:            mchan,
+		DropResponseHeaders: []string{"server", "X-POWERED-BY"},
+	})
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodGet, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	validateBody(t, res.Body, responseBody)
+	validateHeaders(t, res.Header, responseHeaders)
+	require.Empty(t, res.Header.Get("Server"))
+	require.Empty(t, res.Header.Get("X-Powered-By"))
+
+	data := <-mchan
+	require.Equal(t, "internal/1.2.3", data.ResponseHeader.Get("Server"))
+	require.Equal(t, "internals", data.ResponseHeader.Get("X-Powered-By"))
+}
+
+func TestRequestBodyLength(t *testing.T) {
+	for name, chunked := range map[string]bool{"chunked": true, "fixed": false} {
+		t.Run(name, func(t *testing.T) {
+			var length int64
+			var encoding []string
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				validateBody(t, r.Body, requestBody)
+				length = r.ContentLength
+				encoding = r.TransferEncoding
+			}))
+			defer target.Close()
+
+			h, err := proxy.NewHandler(target.URL, timeout, make(chan proxy.Data, 1), nil)
+			require.NoError(t, err)
+
+			prx := httptest.NewServer(h)
+			defer prx.Close()
+
+			var body io.Reader = strings.NewReader(requestBody)
+			if chunked {
+				// hide the length from the client, so that it sends the body chunked
+				body = io.MultiReader(body)
+			}
+			res, err := prx.Client().Post(prx.URL, "text/xml", body)
+			require.NoError(t, err)
+			res.Body.Close()
+			require.Equal(t, http.StatusOK, res.StatusCode)
+
+			if chunked {
+				require.Equal(t, int64(-1), length)
+				require.Equal(t, []string{"chunked"}, encoding)
+			} else {
+				require.Equal(t, int64(len(requestBody)), length)
+				require.Empty(t, encoding)
+			}
+		})
+	}
+}
+
+func TestResponseBodyTransformKeepAlive(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(responseBody)))
+		w.Write([]byte(responseBody))
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL: target.URL,
+		Timeout:   timeout,
+		DataChan:  make(chan proxy.Data, 2),
+		ResponseBodyTransform: func(body io.Reader) (io.Reader, error) {
+			// the body grows, the Content-Length of the upstream is too short
+			return io.MultiReader(body, strings.NewReader(responseBody)), nil
+		},
+	})
+	require.NoError(t, err)
+
+	prx := httptest.NewServer(h)
+	defer prx.Close()
+	client := prx.Client()
+
+	var reused bool
+	for i := 0; i < 2; i++ {
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused }}
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, prx.URL, nil)
+		require.NoError(t, err)
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		validateBody(t, res.Body, responseBody+responseBody)
+		res.Body.Close()
+	}
+	require.True(t, reused, "the second request must reuse the connection")
+}
+
+func TestCaptureRedactor(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+	const card = "4111-1111-1111-1111"
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validateBody(t, r.Body, "card="+card)
+		w.Write([]byte("charged " + card))
+	}))
+	defer target.Close()
+
+	cards := regexp.MustCompile(`\d{4}-\d{4}-\d{4}-\d{4}`)
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:       target.URL,
+		Timeout:         timeout,
+		DataChan:        mchan,
+		CaptureRequest:  true,
+		CaptureResponse: true,
+		CaptureRedactor: func(captured []byte) []byte {
+			return cards.ReplaceAll(captured, []byte("XXXX-XXXX-XXXX-XXXX"))
+		},
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("card="+card)))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "charged "+card, w.Body.String())
+
+	data := <-mchan
+	captured, err := io.ReadAll(data.Request)
+	require.NoError(t, err)
+	require.Equal(t, "card=XXXX-XXXX-XXXX-XXXX", string(captured))
+	captured, err = io.ReadAll(data.Response)
+	require.NoError(t, err)
+	require.Equal(t, "charged XXXX-XXXX-XXXX-XXXX", string(captured))
+}
+
+func TestExpectContinue(t *testing.T) {
+	for name, disabled := range map[string]bool{"forwarded": false, "disabled": true} {
+		t.Run(name, func(t *testing.T) {
+			expect := make(chan string, 1)
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				expect <- r.Header.Get("Expect")
+				validateBody(t, r.Body, requestBody)
+			}))
+			defer target.Close()
+
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL:             target.URL,
+				Timeout:               timeout,
+				ExpectContinueTimeout: time.Minute,
+				DisableExpectContinue: disabled,
+			})
+			require.NoError(t, err)
+
+			prx := httptest.NewServer(h)
+			defer prx.Close()
+
+			// the client and the proxy would wait a minute for a 100 Continue
+			// that never comes
+			client := prx.Client()
+			client.Transport.(*http.Transport).ExpectContinueTimeout = time.Minute
+			client.Timeout = 5 * time.Second
+
+			req, err := http.NewRequest(http.MethodPost, prx.URL, strings.NewReader(requestBody))
+			require.NoError(t, err)
+			req.Header.Set("Expect", "100-continue")
+
+			res, err := client.Do(req)
+			require.NoError(t, err)
+			res.Body.Close()
+			require.Equal(t, http.StatusOK, res.StatusCode)
+
+			if disabled {
+				require.Empty(t, <-expect)
+			} else {
+				require.Equal(t, "100-continue", <-expect)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL: target.URL,
+		Timeout:   timeout,
+		DataChan:  mchan,
+		Validate: func(r *http.Request) error {
+			if r.Header.Get("Content-Type") == "" {
+				return errors.New("Content-Type is required")
+			}
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(requestBody))
+	w := httptest.NewRecorder()
+	h(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, "Content-Type is required\n", w.Body.String())
+	require.Zero(t, atomic.LoadInt32(&hits), "the upstream must not be contacted")
+	require.Len(t, mchan, 0, "rejected requests must not be published")
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(requestBody))
+	req.Header.Set("Content-Type", "text/plain")
+	w = httptest.NewRecorder()
+	h(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, int32(1), atomic.LoadInt32(&hits))
+	require.Len(t, mchan, 1)
+}
+
+func TestMaxResponseBodyBytes(t *testing.T) {
+	const body = "0123456789"
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write([]byte(body))
+	}))
+	defer target.Close()
+
+	cases := map[string]struct {
+		limit     int64
+		expected  string
+		truncated bool
+	}{
+		"under the limit": {20, body, false},
+		"at the limit":    {10, body, false},
+		"over the limit":  {4, "0123", true},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			mchan := make(chan proxy.Data, 1)
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL:            target.URL,
+				Timeout:              timeout,
+				DataChan:             mchan,
+				MaxResponseBodyBytes: c.limit,
+			})
+			require.NoError(t, err)
+
+			// the client must see a complete response, not a broken one
+			res := doRequest(t, h, http.MethodGet, nil)
+			require.Equal(t, http.StatusOK, res.StatusCode)
+			validateBody(t, res.Body, c.expected)
+
+			data := <-mchan
+			require.Equal(t, c.truncated, data.ResponseTruncated)
+			require.False(t, data.ResponseInterrupted)
+			require.Equal(t, int64(len(c.expected)), data.ResponseBytes)
+		})
+	}
+}
+
+func TestUpstreamURL(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:   target.URL + "/service",
+		Timeout:     timeout,
+		DataChan:    mchan,
+		StripPrefix: "/api",
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/api/users?page=2", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	data := <-mchan
+	require.Equal(t, target.URL+"/service/users?page=2", data.UpstreamURL)
+}
+
+func TestModifyRequest(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Query().Get("tenant")))
+	}))
+	defer target.Close()
+
+	fail := false
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL: target.URL,
+		Timeout:   timeout,
+		DataChan:  mchan,
+		ModifyRequest: func(req *http.Request) error {
+			if fail {
+				return errors.New("no tenant")
+			}
+			q := req.URL.Query()
+			q.Set("tenant", "acme")
+			req.URL.RawQuery = q.Encode()
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "acme", w.Body.String())
+	require.Equal(t, target.URL+"/?tenant=acme", (<-mchan).UpstreamURL)
+
+	fail = true
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.Len(t, mchan, 0, "rejected requests must not be published")
+}
+
+func TestModifyRequestShared(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Length", strconv.Itoa(len(r.URL.RawQuery)))
+		w.Write([]byte(r.URL.RawQuery))
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:       target.URL,
+		Timeout:         timeout,
+		CacheMaxEntries: 10,
+		Coalesce:        true,
+		ModifyRequest: func(req *http.Request) error {
+			req.URL.RawQuery = "tenant=" + req.Header.Get("X-Tenant")
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	// callers rewritten to different upstream requests must not share responses
+	get := func(tenant string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Tenant", tenant)
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w.Body.String()
+	}
+	require.Equal(t, "tenant=acme", get("acme"))
+	require.Equal(t, "tenant=globex", get("globex"))
+	require.Equal(t, "tenant=acme", get("acme"))
+}
+
+func TestModifyResponse(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(responseBody))
+	}))
+	defer target.Close()
+
+	var fail error
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL: target.URL,
+		Timeout:   timeout,
+		DataChan:  mchan,
+		ModifyResponse: func(res *http.Response) error {
+			res.Header.Set("X-Proxied-By", "proxy")
+			return fail
+		},
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "proxy", w.Header().Get("X-Proxied-By"))
+	require.Equal(t, responseBody, w.Body.String())
+	require.Equal(t, "proxy", (<-mchan).ResponseHeader.Get("X-Proxied-By"))
+
+	fail = errors.New("unexpected response")
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusBadGateway, w.Code)
+	data := <-mchan
+	require.Equal(t, http.StatusBadGateway, data.StatusCode)
+	require.ErrorIs(t, data.Error, fail)
+}
+
+func TestHonorRetryAfter(t *testing.T) {
+	cases := map[string]struct {
+		method     string
+		retryAfter string
+		status     int
+		hits       int32
+		wait       time.Duration
+	}{
+		"retried":        {http.MethodGet, "1", http.StatusOK, 2, time.Second},
+		"http date":      {http.MethodGet, time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), http.StatusOK, 2, 0},
+		"over the cap":   {http.MethodGet, "120", http.StatusServiceUnavailable, 1, 0},
+		"not idempotent": {http.MethodPost, "1", http.StatusServiceUnavailable, 1, 0},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			mchan := make(chan proxy.Data, 1)
+
+			var hits int32
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&hits, 1) == 1 {
+					w.Header().Set("Retry-After", c.retryAfter)
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Write([]byte(responseBody))
+			}))
+			defer target.Close()
+
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL:       target.URL,
+				Timeout:         timeout,
+				DataChan:        mchan,
+				HonorRetryAfter: true,
+				MaxRetryAfter:   time.Minute,
+			})
+			require.NoError(t, err)
+
+			var body io.Reader
+			if c.method == http.MethodPost {
+				body = strings.NewReader(requestBody)
+			}
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(c.method, "/", body))
+			require.Equal(t, c.status, w.Code)
+			require.Equal(t, c.hits, atomic.LoadInt32(&hits))
+			require.Equal(t, c.wait, (<-mchan).RetryAfterWait)
+		})
+	}
+}
+
+// rawServer answers every request on its connection with the given raw response
+func rawServer(t *testing.T, response string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+					io.WriteString(conn, response)
+				}
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+// funcTransport is a http.RoundTripper calling itself
+type funcTransport func(*http.Request) (*http.Response, error)
+
+func (f funcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestAmbiguousLength(t *testing.T) {
+	t.Run("conflicting upstream lengths", func(t *testing.T) {
+		mchan := make(chan proxy.Data, 1)
+		target := rawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Length: 50\r\n\r\nhello")
+		h, err := proxy.NewHandler(target, timeout, mchan, nil)
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusBadGateway, rec.Code)
+		require.NotContains(t, rec.Body.String(), "hello")
+		require.Error(t, (<-mchan).Error)
+	})
+
+	t.Run("upstream length and chunked", func(t *testing.T) {
+		mchan := make(chan proxy.Data, 1)
+		h, err := proxy.NewHandlerWithConfig(proxy.Config{
+			TargetURL: "http://upstream.invalid",
+			Timeout:   timeout,
+			DataChan:  mchan,
+			Transport: funcTransport(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode:       http.StatusOK,
+					Header:           http.Header{"Content-Length": {"5"}},
+					TransferEncoding: []string{"chunked"},
+					Body:             io.NopCloser(strings.NewReader("hello, smuggled")),
+					Request:          req,
+				}, nil
+			}),
+		})
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusBadGateway, rec.Code)
+		require.NotContains(t, rec.Body.String(), "smuggled")
+		require.ErrorIs(t, (<-mchan).Error, proxy.ErrAmbiguousLength)
+	})
+
+	t.Run("upstream chunked framing wins", func(t *testing.T) {
+		// net/http drops the Content-Length of chunked responses, the client
+		// gets the message framed anew
+		target := rawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n")
+		h, err := proxy.NewHandler(target, timeout, nil, nil)
+		require.NoError(t, err)
+
+		res := doRequest(t, h, http.MethodGet, nil)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		validateBody(t, res.Body, "hello")
+	})
+
+	t.Run("request length and chunked", func(t *testing.T) {
+		var hits int32
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+		}))
+		defer target.Close()
+		mchan := make(chan proxy.Data, 1)
+		h, err := proxy.NewHandler(target.URL, timeout, mchan, nil)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(requestBody))
+		req.Header.Set("Content-Length", "5")
+		req.Header.Set("Transfer-Encoding", "chunked")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+		require.Zero(t, atomic.LoadInt32(&hits), "the upstream must not be contacted")
+		require.Len(t, mchan, 0, "rejected requests must not be published")
+	})
+}
+
+func TestNotModified(t *testing.T) {
+	const etag = `"v1"`
+	lastModified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Format(http.TimeFormat)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		if r.Header.Get("If-None-Match") == etag || r.Header.Get("If-Modified-Since") == lastModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeResponse(w, responseBody, nil)
+	}))
+	defer target.Close()
+
+	appending := func(body io.Reader) (io.Reader, error) {
+		return io.MultiReader(body, strings.NewReader(" and more")), nil
+	}
+	configs := map[string]proxy.Config{
+		"plain":      {},
+		"transform":  {ResponseBodyTransform: appending},
+		"compressed": {CompressResponses: true},
+		"limited":    {MaxResponseBodyBytes: 5},
+	}
+	conditions := map[string]string{"If-None-Match": etag, "If-Modified-Since": lastModified}
+	for name, cfg := range configs {
+		for header, value := range conditions {
+			t.Run(name+" "+header, func(t *testing.T) {
+				mchan := make(chan proxy.Data, 1)
+				cfg.TargetURL = target.URL
+				cfg.Timeout = timeout
+				cfg.DataChan = mchan
+				cfg.CaptureResponse = true
+				h, err := proxy.NewHandlerWithConfig(cfg)
+				require.NoError(t, err)
+
+				prx := httptest.NewServer(h)
+				defer prx.Close()
+
+				// read the raw response, a client could be lenient about a stray body
+				conn, err := net.Dial("tcp", prx.Listener.Addr().String())
+				require.NoError(t, err)
+				defer conn.Close()
+				fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: proxy\r\nAccept-Encoding: gzip\r\n%s: %s\r\n\r\n", header, value)
+				// a second request on the connection must be answered in sync
+				fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: proxy\r\nConnection: close\r\n\r\n")
+				raw, err := io.ReadAll(conn)
+				require.NoError(t, err)
+
+				head, rest, ok := strings.Cut(string(raw), "\r\n\r\n")
+				require.True(t, ok)
+				require.True(t, strings.HasPrefix(head, "HTTP/1.1 304 Not Modified\r\n"), head)
+				require.Contains(t, head, "\r\nEtag: "+etag)
+				require.Contains(t, head, "\r\nLast-Modified: "+lastModified)
+				require.Contains(t, head, "\r\nCache-Control: max-age=60")
+				require.NotContains(t, head, "Content-Encoding")
+				require.NotContains(t, head, "Transfer-Encoding")
+				require.NotContains(t, head, "Content-Length")
+				require.True(t, strings.HasPrefix(rest, "HTTP/1.1 200 OK\r\n"), "the 304 must have no body, got %q", rest)
+
+				data := <-mchan
+				require.NoError(t, data.Error)
+				require.Equal(t, http.StatusNotModified, data.StatusCode)
+				require.False(t, data.ResponseInterrupted)
+				require.Zero(t, data.ResponseBytes)
+			})
+		}
+	}
+}
+
+func TestHTTP10Client(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/length" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(responseBody)))
+		}
+		// flushed without a length, the upstream response is chunked
+		io.WriteString(w, responseBody)
+		w.(http.Flusher).Flush()
+	}))
+	defer target.Close()
+
+	newProxy := func(cfg proxy.Config) *httptest.Server {
+		cfg.TargetURL = target.URL
+		cfg.Timeout = timeout
+		h, err := proxy.NewHandlerWithConfig(cfg)
+		require.NoError(t, err)
+		return httptest.NewServer(h)
+	}
+	dial := func(prx *httptest.Server) net.Conn {
+		conn, err := net.Dial("tcp", prx.Listener.Addr().String())
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(timeout))
+		return conn
+	}
+
+	t.Run("unknown length", func(t *testing.T) {
+		for name, cfg := range map[string]proxy.Config{"plain": {}, "compressed": {CompressResponses: true}} {
+			t.Run(name, func(t *testing.T) {
+				prx := newProxy(cfg)
+				defer prx.Close()
+				conn := dial(prx)
+				defer conn.Close()
+
+				// even asked to, the proxy can't keep the connection without a length
+				fmt.Fprintf(conn, "GET / HTTP/1.0\r\nConnection: keep-alive\r\nAccept-Encoding: gzip\r\n\r\n")
+				raw, err := io.ReadAll(conn)
+				require.NoError(t, err, "the end of the body must be told by closing the connection")
+
+				head, body, ok := strings.Cut(string(raw), "\r\n\r\n")
+				require.True(t, ok)
+				require.True(t, strings.HasPrefix(head, "HTTP/1.0 200 OK\r\n"), head)
+				require.NotContains(t, head, "Transfer-Encoding")
+				require.NotContains(t, head, "Connection: keep-alive")
+				if cfg.CompressResponses {
+					require.Contains(t, head, "\r\nContent-Encoding: gzip")
+					gz, err := gzip.NewReader(strings.NewReader(body))
+					require.NoError(t, err)
+					validateBody(t, gz, responseBody)
+				} else {
+					require.Equal(t, responseBody, body)
+				}
+			})
+		}
+	})
+
+	t.Run("keep-alive", func(t *testing.T) {
+		prx := newProxy(proxy.Config{})
+		defer prx.Close()
+		conn := dial(prx)
+		defer conn.Close()
+
+		br := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			fmt.Fprintf(conn, "GET /length HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+			res, err := http.ReadResponse(br, nil)
+			require.NoError(t, err)
+			require.Equal(t, "HTTP/1.0", res.Proto)
+			require.Empty(t, res.TransferEncoding)
+			require.Equal(t, int64(len(responseBody)), res.ContentLength)
+			require.Equal(t, "keep-alive", res.Header.Get("Connection"))
+			validateBody(t, res.Body, responseBody)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+// signature opening PROXY protocol version 2 headers
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// dialFunc dials upstream connections, like net.Dialer.DialContext
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// clientAddrsKey is the context key of the addresses of the client connection
+type clientAddrsKey struct{}
+
+// clientAddrs are the ends of the client connection of a request
+type clientAddrs struct {
+	src, dst netip.AddrPort
+}
+
+// withClientAddrs stores the addresses of the client connection of r into ctx,
+// for the PROXY protocol header of the upstream connection
+func withClientAddrs(ctx context.Context, r *http.Request) context.Context {
+	var addrs clientAddrs
+	addrs.src, _ = netip.ParseAddrPort(r.RemoteAddr)
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		addrs.dst, _ = netip.ParseAddrPort(local.String())
+	}
+	return context.WithValue(ctx, clientAddrsKey{}, addrs)
+}
+
+// withProxyHeader wraps dial to open every connection with a PROXY protocol
+// header of the given version, carrying the client addresses of the request
+func withProxyHeader(version int, dial dialFunc) dialFunc {
+	if version == 0 {
+		return dial
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs, _ := ctx.Value(clientAddrsKey{}).(clientAddrs)
+		if _, err := conn.Write(proxyHeader(version, addrs.src, addrs.dst)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy: write PROXY protocol header: %w", err)
+		}
+		return conn, nil
+	}
+}
+
+// proxyHeader renders the PROXY protocol header of the given version for a
+// connection from src to dst. Addresses not known, or of different families,
+// are sent as UNKNOWN
+func proxyHeader(version int, src, dst netip.AddrPort) []byte {
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	known := src.IsValid() && dst.IsValid() && src.Addr().Is4() == dst.Addr().Is4()
+
+	if version == 1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		proto := "TCP4"
+		if src.Addr().Is6() {
+			proto = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, src.Addr(), dst.Addr(), src.Port(), dst.Port()))
+	}
+
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+	if !known {
+		// LOCAL command, the receiver uses the real connection addresses
+		b.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return b.Bytes()
+	}
+
+	family := byte(0x11) // TCP over IPv4
+	if src.Addr().Is6() {
+		family = 0x21 // TCP over IPv6
+	}
+	srcIP, dstIP := src.Addr().AsSlice(), dst.Addr().AsSlice()
+	b.Write([]byte{0x21, family})
+	binary.Write(&b, binary.BigEndian, uint16(2*len(srcIP)+4))
+	b.Write(srcIP)
+	b.Write(dstIP)
+	binary.Write(&b, binary.BigEndian, src.Port())
+	binary.Write(&b, binary.BigEndian, dst.Port())
+	return b.Bytes()
+}
@@ -0,0 +1,92 @@
+package proxy_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// serveProxyProtocol accepts a single connection on l, sends its PROXY
+// protocol header of the given version to headers, and answers the HTTP
+// request following it
+func serveProxyProtocol(t *testing.T, l net.Listener, version int, headers chan<- []byte) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	var header []byte
+	if version == 1 {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		header = []byte(line)
+	} else {
+		header = make([]byte, 16)
+		_, err := io.ReadFull(br, header)
+		require.NoError(t, err)
+		addrs := make([]byte, binary.BigEndian.Uint16(header[14:]))
+		_, err = io.ReadFull(br, addrs)
+		require.NoError(t, err)
+		header = append(header, addrs...)
+	}
+	headers <- header
+
+	_, err = http.ReadRequest(br)
+	require.NoError(t, err)
+	fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+}
+
+func TestProxyProtocol(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer l.Close()
+
+			headers := make(chan []byte, 1)
+			go serveProxyProtocol(t, l, version, headers)
+
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL:     "http://" + l.Addr().String(),
+				Timeout:       timeout,
+				ProxyProtocol: version,
+			})
+			require.NoError(t, err)
+
+			prx := httptest.NewServer(h)
+			defer prx.Close()
+			u, err := url.Parse(prx.URL)
+			require.NoError(t, err)
+			_, prxPort, err := net.SplitHostPort(u.Host)
+			require.NoError(t, err)
+
+			res, err := http.Get(prx.URL)
+			require.NoError(t, err)
+			res.Body.Close()
+			require.Equal(t, http.StatusOK, res.StatusCode)
+
+			header := <-headers
+			if version == 1 {
+				require.Regexp(t, regexp.MustCompile(`^PROXY TCP4 127\.0\.0\.1 127\.0\.0\.1 \d+ `+prxPort+"\r\n$"), string(header))
+				return
+			}
+			require.Equal(t, []byte("\r\n\r\n\x00\r\nQUIT\n"), header[:12])
+			require.Equal(t, byte(0x21), header[12], "version 2, PROXY command")
+			require.Equal(t, byte(0x11), header[13], "TCP over IPv4")
+			require.Equal(t, []byte{127, 0, 0, 1, 127, 0, 0, 1}, header[16:24])
+			require.Equal(t, prxPort, fmt.Sprint(binary.BigEndian.Uint16(header[26:28])))
+		})
+	}
+}
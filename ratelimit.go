@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrRateLimited is returned for requests of clients over Config.RateLimit
+var ErrRateLimited = errors.New("proxy: rate limit exceeded")
+
+// rateLimiter keeps a token bucket per client
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+	// buckets unused for this long are full again, and are dropped
+	idle time.Duration
+
+	mu        sync.Mutex
+	clients   map[string]*clientBucket
+	lastSweep time.Time
+}
+
+// clientBucket is the token bucket of a client and when it was last used
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newRateLimiter creates rateLimiter allowing limit requests per second per
+// client, with bursts of up to burst requests. It returns nil for no limit
+func newRateLimiter(limit rate.Limit, burst int) *rateLimiter {
+	if limit <= 0 || limit == rate.Inf {
+		return nil
+	}
+
+	return &rateLimiter{
+		limit:   limit,
+		burst:   burst,
+		idle:    time.Duration(float64(burst) / float64(limit) * float64(time.Second)),
+		clients: make(map[string]*clientBucket),
+	}
+}
+
+// allow reports whether client may make a request at now. If not, it returns
+// how long the client should wait before retrying
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > l.idle {
+		for k, b := range l.clients {
+			if now.Sub(b.lastSeen) > l.idle {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.clients[client]
+	if !ok {
+		b = &clientBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[client] = b
+	}
+	b.lastSeen = now
+
+	r := b.limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		// the request is refused, don't let it take the token
+		r.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// retryAfter formats d as the value of the Retry-After header, in whole seconds
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
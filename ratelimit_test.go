@@ -0,0 +1,45 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimit(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL: target.URL,
+		Timeout:   timeout,
+		DataChan:  mchan,
+		RateLimit: 0.1,
+		RateBurst: 2,
+	})
+	require.NoError(t, err)
+
+	send := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		require.Equal(t, http.StatusOK, send("192.0.2.1:1234").Code)
+	}
+	w := send("192.0.2.1:5678")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "10", w.Header().Get("Retry-After"))
+	require.Len(t, mchan, 2, "throttled requests must not be published")
+
+	// other clients have buckets of their own
+	require.Equal(t, http.StatusOK, send("192.0.2.2:1234").Code)
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// consecutive upstream failures making a proxy unready, see Config.UnreadyAfter
+const defaultUnreadyAfter = 3
+
+// readiness tracks whether the upstream was reached since startup, and how
+// many times in a row it then failed to be
+type readiness struct {
+	mu        sync.Mutex
+	succeeded bool
+	failures  int
+
+	// probe sends a request to an upstream, set by the handler
+	probe func(ctx context.Context) error
+}
+
+// record the outcome of an upstream round trip
+func (r *readiness) record(failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if failed {
+		r.failures++
+		return
+	}
+	r.succeeded = true
+	r.failures = 0
+}
+
+// observe records the outcome of a proxied request, as far as it tells
+// whether the upstream is reachable. Any response proves it is
+func (r *readiness) observe(d *Data) {
+	switch {
+	case replayed(d):
+	case d.ResponseInterrupted || d.ErrorKind == ErrNone || d.ErrorKind == ErrUpstream5xx:
+		r.record(false)
+	case d.ErrorKind == ErrTimeout || unreachable(d):
+		r.record(true)
+	}
+}
+
+// ready reports whether an upstream round trip succeeded, and the last
+// unreadyAfter ones didn't all fail
+func (r *readiness) ready(unreadyAfter int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.succeeded && r.failures < unreadyAfter
+}
+
+// Ready reports whether the proxy may take traffic: the upstream was reached
+// at least once since startup, by a proxied request or a readiness probe,
+// and it didn't fail Config.UnreadyAfter times in a row since
+func (p *Proxy) Ready() bool {
+	return p.counters.ready.ready(p.unreadyAfter)
+}
+
+// ReadinessHandler returns http.HandlerFunc probing the upstream with a HEAD
+// request, like the handler created by NewHealthHandler, and responding with
+// 200 when the proxy is Ready, and with 503 otherwise. A single failed probe
+// doesn't make a ready proxy unready, so that load balancers polling it
+// don't take it out of rotation over a blip
+func (p *Proxy) ReadinessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := p.counters.ready.probe(r.Context())
+		// a probe abandoned by the load balancer says nothing about the upstream
+		if r.Context().Err() == nil {
+			p.counters.ready.record(err != nil)
+		}
+
+		if !p.Ready() {
+			msg := "upstream not reached yet"
+			if err != nil {
+				msg = fmt.Sprintf("upstream unavailable: %s", err)
+			}
+			http.Error(w, msg, http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	}
+}
@@ -0,0 +1,62 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadiness(t *testing.T) {
+	// the upstream drops connections while down
+	var down atomic.Bool
+	down.Store(true)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+			return
+		}
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	p, err := proxy.NewProxy(proxy.Config{
+		TargetURL:    target.URL,
+		Timeout:      timeout,
+		DataChan:     make(chan proxy.Data, 10),
+		UnreadyAfter: 2,
+	})
+	require.NoError(t, err)
+
+	probe := func() int {
+		w := httptest.NewRecorder()
+		p.ReadinessHandler()(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return w.Code
+	}
+
+	// never reached since startup
+	require.False(t, p.Ready())
+	require.Equal(t, http.StatusServiceUnavailable, probe())
+
+	down.Store(false)
+	require.Equal(t, http.StatusOK, probe())
+	require.True(t, p.Ready())
+
+	// a single failure is tolerated, the second one in a row is not
+	down.Store(true)
+	require.Equal(t, http.StatusOK, probe())
+	require.Equal(t, http.StatusServiceUnavailable, probe())
+	require.False(t, p.Ready())
+
+	// proxied traffic reaching the upstream makes it ready again
+	down.Store(false)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.True(t, p.Ready())
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+)
+
+// ErrNoRoute is returned for requests no Route matches, when there's no
+// fallback target. A resolve function of NewDynamicHandler returning it
+// makes the client get 404
+var ErrNoRoute = errors.New("proxy: no route matches the request")
+
+// Route sends the requests matching Method and Path to Target
+type Route struct {
+	// Method of the requests matching, any when empty or "*"
+	Method string
+	// Path pattern of the requests matching: a pattern with wildcards is
+	// matched with path.Match, so * doesn't cross slashes; any other is a path
+	// prefix matching on segment boundaries, like in Config.PathAllowlist
+	Path string
+	// Target URL of the upstream the requests are proxied to
+	Target string
+}
+
+// matches reports whether r is one of the requests of the route
+func (rt *Route) matches(r *http.Request) bool {
+	if rt.Method != "" && rt.Method != "*" && rt.Method != r.Method {
+		return false
+	}
+	return pathMatches(r.URL.Path, rt.Path)
+}
+
+// NewRoutingHandler creates http.HandlerFunc proxying every request to the
+// Target of the first of routes it matches, or to fallback when none does.
+// Without a fallback, requests no route matches get 404, without publishing
+// Data. Apart from that, it behaves like the handler created by
+// NewDynamicHandler
+func NewRoutingHandler(routes []Route, fallback string, timeout time.Duration, ch chan<- Data, cb func(status int, err error)) (http.HandlerFunc, error) {
+	targets := make([]string, 0, len(routes)+1)
+	for _, rt := range routes {
+		if _, err := path.Match(rt.Path, ""); err != nil {
+			return nil, fmt.Errorf("proxy: invalid route path pattern %q: %v", rt.Path, err)
+		}
+		targets = append(targets, rt.Target)
+	}
+	if fallback != "" {
+		targets = append(targets, fallback)
+	}
+	// fail upfront rather than on the first request routed to a bad target
+	for _, t := range targets {
+		if _, err := newUpstream(t); err != nil {
+			return nil, err
+		}
+	}
+
+	routes = append([]Route(nil), routes...)
+	return NewDynamicHandler(func(r *http.Request) (string, error) {
+		for i := range routes {
+			if routes[i].matches(r) {
+				return routes[i].Target, nil
+			}
+		}
+		if fallback == "" {
+			return "", ErrNoRoute
+		}
+		return fallback, nil
+	}, timeout, ch, cb)
+}
@@ -0,0 +1,104 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoutingHandler(t *testing.T) {
+	api := newNamedServer("api")
+	defer api.Close()
+	static := newNamedServer("static")
+	defer static.Close()
+	uploads := newNamedServer("uploads")
+	defer uploads.Close()
+	fallback := newNamedServer("fallback")
+	defer fallback.Close()
+
+	routes := []proxy.Route{
+		{Method: http.MethodPost, Path: "/api/uploads", Target: uploads.URL},
+		{Path: "/api", Target: api.URL},
+		{Method: http.MethodGet, Path: "/static/*.css", Target: static.URL},
+	}
+
+	cases := map[string]struct {
+		method, path string
+		expected     string
+	}{
+		"first match wins":     {http.MethodPost, "/api/uploads/1", "uploads"},
+		"any method":           {http.MethodGet, "/api/uploads/1", "api"},
+		"prefix":               {http.MethodDelete, "/api/users/1", "api"},
+		"glob":                 {http.MethodGet, "/static/site.css", "static"},
+		"glob other method":    {http.MethodPost, "/static/site.css", ""},
+		"glob across segments": {http.MethodGet, "/static/a/site.css", ""},
+		"no match":             {http.MethodGet, "/admin", ""},
+	}
+
+	t.Run("with fallback", func(t *testing.T) {
+		h, err := proxy.NewRoutingHandler(routes, fallback.URL, timeout, nil, nil)
+		require.NoError(t, err)
+
+		for name, c := range cases {
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(c.method, c.path, nil))
+			require.Equal(t, http.StatusOK, w.Code, name)
+			expected := c.expected
+			if expected == "" {
+				expected = "fallback"
+			}
+			require.Equal(t, expected, w.Body.String(), name)
+		}
+	})
+
+	t.Run("without fallback", func(t *testing.T) {
+		mchan := make(chan proxy.Data, 1)
+		h, err := proxy.NewRoutingHandler(routes, "", timeout, mchan, nil)
+		require.NoError(t, err)
+
+		for name, c := range cases {
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(c.method, c.path, nil))
+			if c.expected == "" {
+				require.Equal(t, http.StatusNotFound, w.Code, name)
+				require.Len(t, mchan, 0, "unrouted requests must not be published")
+				continue
+			}
+			require.Equal(t, http.StatusOK, w.Code, name)
+			require.Equal(t, c.expected, w.Body.String(), name)
+			<-mchan
+		}
+	})
+}
+
+func TestRoutingHandlerDotSegments(t *testing.T) {
+	api := newNamedServer("api")
+	defer api.Close()
+	admin := newNamedServer("admin")
+	defer admin.Close()
+
+	// routed to api by its prefix, the request would reach /admin there
+	h, err := proxy.NewRoutingHandler([]proxy.Route{{Path: "/api", Target: api.URL}}, admin.URL, timeout, nil, nil)
+	require.NoError(t, err)
+
+	for _, path := range []string{"/api/../admin", "/api/%2e%2e/admin"} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+}
+
+func TestRoutingHandlerInvalidRoutes(t *testing.T) {
+	for name, routes := range map[string][]proxy.Route{
+		"bad target":  {{Path: "/api", Target: "/relative"}},
+		"bad pattern": {{Path: "/api/[", Target: "http://localhost"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := proxy.NewRoutingHandler(routes, "", timeout, nil, nil)
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package proxy
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+)
+
+// header of clients deciding whether their request is sampled
+const traceSampledHeader = "X-Trace-Sampled"
+
+// sampled reports whether r is part of the sample taken at rate, see
+// Config.Sampling. The header of the client wins over chance, whatever the
+// rate
+func sampled(r *http.Request, rate float64) bool {
+	if ok, err := strconv.ParseBool(r.Header.Get(traceSampledHeader)); err == nil {
+		return ok
+	}
+	return rand.Float64() < rate
+}
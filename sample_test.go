@@ -0,0 +1,108 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampleRate(t *testing.T) {
+	const requests = 2000
+	mchan := make(chan proxy.Data, requests)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(responseBody))
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:       target.URL,
+		Timeout:         timeout,
+		DataChan:        mchan,
+		CaptureRequest:  true,
+		CaptureResponse: true,
+		Sampling:        true,
+		SampleRate:      0.25,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < requests; i++ {
+		h(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader(requestBody)))
+	}
+
+	// every request is published, but only the sampled ones with bodies
+	require.Len(t, mchan, requests)
+	captured := 0
+	for i := 0; i < requests; i++ {
+		d := <-mchan
+		require.Equal(t, d.Sampled, d.Request != nil)
+		require.Equal(t, d.Sampled, d.Response != nil)
+		if d.Sampled {
+			captured++
+		}
+	}
+	require.InDelta(t, requests/4, captured, requests/20)
+}
+
+func TestTraceSampledHeader(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	// the client decides even at the rates capturing none or all
+	for _, rate := range []float64{0, 0.5, 1} {
+		mchan := make(chan proxy.Data, 1)
+		h, err := proxy.NewHandlerWithConfig(proxy.Config{
+			TargetURL:       target.URL,
+			Timeout:         timeout,
+			DataChan:        mchan,
+			CaptureResponse: true,
+			Sampling:        true,
+			SampleRate:      rate,
+		})
+		require.NoError(t, err)
+
+		for _, v := range []string{"1", "0"} {
+			for i := 0; i < 20; i++ {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("X-Trace-Sampled", v)
+				h(httptest.NewRecorder(), req)
+				require.Equal(t, v == "1", (<-mchan).Sampled, "rate %g", rate)
+			}
+		}
+
+		// without the header, the rate decides
+		if rate != 0.5 {
+			h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			require.Equal(t, rate == 1, (<-mchan).Sampled, "rate %g", rate)
+		}
+	}
+}
+
+func TestSamplingDisabled(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:       target.URL,
+		Timeout:         timeout,
+		DataChan:        mchan,
+		CaptureResponse: true,
+	})
+	require.NoError(t, err)
+
+	// without sampling, every request is sampled, asked or not
+	for _, v := range []string{"", "1", "0"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if v != "" {
+			req.Header.Set("X-Trace-Sampled", v)
+		}
+		h(httptest.NewRecorder(), req)
+		require.True(t, (<-mchan).Sampled)
+	}
+}
@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// SchemaValidator validates JSON request bodies, see Config.JSONSchema.
+// The error of an invalid body is sent to the client
+type SchemaValidator interface {
+	ValidateJSON(body []byte) error
+}
+
+// methods with bodies validated when Config.SchemaMethods is empty
+var defaultSchemaMethods = []string{http.MethodPost, http.MethodPut, http.MethodPatch}
+
+// largest body validated when Config.MaxRequestBodyBytes doesn't set a limit
+const maxValidatedBodyBytes = 1 << 20
+
+// keywords of the subset of JSON schema the built-in validator checks, and
+// the annotations it accepts without checking anything
+var schemaKeywords = map[string]bool{
+	"type": true, "enum": true, "const": true, "properties": true, "required": true,
+	"additionalProperties": true, "items": true, "minimum": true, "maximum": true,
+	"minLength": true, "maxLength": true, "minItems": true, "maxItems": true, "pattern": true,
+
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true, "deprecated": true, "readOnly": true, "writeOnly": true,
+}
+
+// NewJSONSchemaValidator compiles a JSON schema into a SchemaValidator.
+// It supports the keywords type, enum, const, properties, required,
+// additionalProperties, items, minimum, maximum, minLength, maxLength,
+// minItems, maxItems and pattern, and annotations like title and
+// description. Schemas with other keywords, like $ref or oneOf, are refused
+// rather than partly checked, which would let invalid bodies through
+func NewJSONSchemaValidator(schema []byte) (SchemaValidator, error) {
+	var s jsonSchema
+	if err := json.Unmarshal(schema, &s); err != nil {
+		return nil, fmt.Errorf("proxy: invalid JSON schema: %v", err)
+	}
+	return &s, nil
+}
+
+// loadSchema sets SchemaValidator from JSONSchema or JSONSchemaFile, unless
+// a validator of its own is given
+func (c *Config) loadSchema() error {
+	if c.SchemaValidator != nil || (c.JSONSchema == "" && c.JSONSchemaFile == "") {
+		return nil
+	}
+
+	schema := []byte(c.JSONSchema)
+	if c.JSONSchemaFile != "" {
+		var err error
+		if schema, err = os.ReadFile(c.JSONSchemaFile); err != nil {
+			return fmt.Errorf("proxy: reading JSON schema: %v", err)
+		}
+	}
+	v, err := NewJSONSchemaValidator(schema)
+	if err != nil {
+		return err
+	}
+	c.SchemaValidator = v
+	return nil
+}
+
+// schemaApplies reports whether the body of r must be validated against the
+// schema of cfg
+func schemaApplies(r *http.Request, cfg *Config) bool {
+	if cfg.SchemaValidator == nil {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" && !(strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json")) {
+		return false
+	}
+	methods := cfg.SchemaMethods
+	if len(methods) == 0 {
+		methods = defaultSchemaMethods
+	}
+	if !methodAllowed(r.Method, methods) {
+		return false
+	}
+	return len(cfg.SchemaPaths) == 0 || pathAllowed(r.URL.Path, cfg.SchemaPaths)
+}
+
+// validateSchema returns the rejection of a request with a body raw invalid
+// against the schema of cfg, nil for a valid one
+func validateSchema(raw []byte, cfg *Config) error {
+	if err := cfg.SchemaValidator.ValidateJSON(raw); err != nil {
+		return &rejection{status: http.StatusUnprocessableEntity, err: fmt.Errorf("proxy: invalid request body: %w", err), message: err.Error()}
+	}
+	return nil
+}
+
+// jsonSchema is the compiled subset of JSON schema checked by the built-in
+// validator
+type jsonSchema struct {
+	// never is set by the schema false, which no value matches
+	never bool
+	// hasConst tells a const of null from none
+	hasConst bool
+
+	Type                 schemaTypes            `json:"type"`
+	Enum                 []any                  `json:"enum"`
+	Const                any                    `json:"const"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *jsonSchema            `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	Pattern              string                 `json:"pattern"`
+
+	pattern *regexp.Regexp
+}
+
+func (s *jsonSchema) UnmarshalJSON(data []byte) error {
+	switch string(bytes.TrimSpace(data)) {
+	case "true":
+		*s = jsonSchema{}
+		return nil
+	case "false":
+		*s = jsonSchema{never: true}
+		return nil
+	}
+
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keywords); err != nil {
+		return err
+	}
+	for keyword := range keywords {
+		if !schemaKeywords[keyword] {
+			return fmt.Errorf("unsupported keyword %q", keyword)
+		}
+	}
+
+	// the alias has no UnmarshalJSON method, which would recurse
+	type plain jsonSchema
+	if err := json.Unmarshal(data, (*plain)(s)); err != nil {
+		return err
+	}
+	_, s.hasConst = keywords["const"]
+	if s.Pattern != "" {
+		var err error
+		if s.pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", s.Pattern, err)
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) ValidateJSON(body []byte) error {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return errors.New("body is not valid JSON")
+	}
+	return s.validate("", v)
+}
+
+// validate checks v, found at the JSON pointer at, against s
+func (s *jsonSchema) validate(at string, v any) error {
+	if s.never {
+		return schemaError(at, "no value is allowed")
+	}
+	if len(s.Type) > 0 && !s.Type.match(v) {
+		return schemaError(at, "must be of type "+s.Type.String())
+	}
+	if s.hasConst && !reflect.DeepEqual(v, s.Const) {
+		return schemaError(at, "must be the constant value")
+	}
+	if len(s.Enum) > 0 && !inEnum(v, s.Enum) {
+		return schemaError(at, "must be one of the enumerated values")
+	}
+
+	switch v := v.(type) {
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return schemaError(at, "must be at least "+formatNumber(*s.Minimum))
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return schemaError(at, "must be at most "+formatNumber(*s.Maximum))
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			return schemaError(at, fmt.Sprintf("must be at least %d characters long", *s.MinLength))
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return schemaError(at, fmt.Sprintf("must be at most %d characters long", *s.MaxLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return schemaError(at, fmt.Sprintf("must match the pattern %q", s.Pattern))
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return schemaError(at, fmt.Sprintf("must have at least %d items", *s.MinItems))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return schemaError(at, fmt.Sprintf("must have at most %d items", *s.MaxItems))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(at+"/"+strconv.Itoa(i), item); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return schemaError(at, fmt.Sprintf("missing required property %q", name))
+			}
+		}
+		// sorted, so that the same body always fails on the same property
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			if !ok {
+				prop = s.AdditionalProperties
+			}
+			if prop == nil {
+				continue
+			}
+			if err := prop.validate(at+"/"+escapePointer(name), v[name]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// schemaTypes holds the type keyword, which is either a name or a list of them
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var name string
+	if json.Unmarshal(data, &name) == nil {
+		*t = schemaTypes{name}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(t))
+}
+
+func (t schemaTypes) match(v any) bool {
+	for _, name := range t {
+		switch v := v.(type) {
+		case nil:
+			if name == "null" {
+				return true
+			}
+		case bool:
+			if name == "boolean" {
+				return true
+			}
+		case float64:
+			if name == "number" || (name == "integer" && v == math.Trunc(v)) {
+				return true
+			}
+		case string:
+			if name == "string" {
+				return true
+			}
+		case []any:
+			if name == "array" {
+				return true
+			}
+		case map[string]any:
+			if name == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t schemaTypes) String() string {
+	if len(t) == 1 {
+		return t[0]
+	}
+	return fmt.Sprint([]string(t))
+}
+
+func inEnum(v any, enum []any) bool {
+	for _, e := range enum {
+		if reflect.DeepEqual(v, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// escapePointer escapes a property name for a JSON pointer, see RFC 6901
+func escapePointer(name string) string {
+	var b bytes.Buffer
+	for _, r := range name {
+		switch r {
+		case '~':
+			b.WriteString("~0")
+		case '/':
+			b.WriteString("~1")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func formatNumber(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func schemaError(at, reason string) error {
+	if at == "" {
+		at = "/"
+	}
+	return fmt.Errorf("%s: %s", at, reason)
+}
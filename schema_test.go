@@ -0,0 +1,177 @@
+package proxy_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+const userSchema = `{
+	"type": "object",
+	"required": ["name", "age"],
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0},
+		"tags": {"type": "array", "items": {"enum": ["admin", "user"]}}
+	},
+	"additionalProperties": false
+}`
+
+func TestJSONSchema(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	var hits int32
+	var forwarded string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		body, _ := io.ReadAll(r.Body)
+		forwarded = string(body)
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:   target.URL,
+		Timeout:     timeout,
+		DataChan:    mchan,
+		JSONSchema:  userSchema,
+		SchemaPaths: []string{"/users"},
+	})
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		method, path, contentType, body string
+		status                          int
+		message                         string
+	}{
+		"valid":              {http.MethodPost, "/users", "application/json", `{"name": "ann", "age": 30, "tags": ["admin"]}`, http.StatusOK, ""},
+		"missing property":   {http.MethodPost, "/users", "application/json", `{"name": "ann"}`, http.StatusUnprocessableEntity, `/: missing required property "age"`},
+		"wrong type":         {http.MethodPut, "/users/1", "application/json; charset=utf-8", `{"name": "ann", "age": 1.5}`, http.StatusUnprocessableEntity, "/age: must be of type integer"},
+		"nested":             {http.MethodPatch, "/users", "application/json", `{"name": "ann", "age": 3, "tags": ["root"]}`, http.StatusUnprocessableEntity, "/tags/0: must be one of the enumerated values"},
+		"unknown property":   {http.MethodPost, "/users", "application/json", `{"name": "ann", "age": 3, "admin": true}`, http.StatusUnprocessableEntity, "/admin: no value is allowed"},
+		"malformed":          {http.MethodPost, "/users", "application/json", `{"name":`, http.StatusUnprocessableEntity, "body is not valid JSON"},
+		"empty":              {http.MethodPost, "/users", "application/json", ``, http.StatusUnprocessableEntity, "body is not valid JSON"},
+		"structured suffix":  {http.MethodPost, "/users", "application/vnd.user+json", `{"name": "ann"}`, http.StatusUnprocessableEntity, `/: missing required property "age"`},
+		"other content type": {http.MethodPost, "/users", "text/plain", `{"name":`, http.StatusOK, ""},
+		"other path":         {http.MethodPost, "/orders", "application/json", `{}`, http.StatusOK, ""},
+		"other method":       {http.MethodDelete, "/users", "application/json", `{}`, http.StatusOK, ""},
+		"dot segments":       {http.MethodPost, "/orders/../users", "application/json", `{}`, http.StatusBadRequest, "Bad Request"},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			before := atomic.LoadInt32(&hits)
+			req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+			if c.body == "" {
+				// as the server has it for Content-Length: 0
+				req.Body = http.NoBody
+			}
+			req.Header.Set("Content-Type", c.contentType)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			require.Equal(t, c.status, rec.Code)
+
+			if c.status == http.StatusOK {
+				require.Equal(t, before+1, atomic.LoadInt32(&hits))
+				require.Equal(t, c.body, forwarded, "the body must be forwarded as is")
+				<-mchan
+			} else {
+				require.Equal(t, c.message, strings.TrimSpace(rec.Body.String()))
+				require.Equal(t, before, atomic.LoadInt32(&hits), "the upstream must not be contacted")
+				require.Len(t, mchan, 0, "rejected requests must not be published")
+			}
+		})
+	}
+}
+
+type rejectAll struct{}
+
+func (rejectAll) ValidateJSON([]byte) error { return errors.New("rejected") }
+
+func TestSchemaValidator(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	// a validator of its own takes precedence over the schema
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:       target.URL,
+		Timeout:         timeout,
+		JSONSchema:      `true`,
+		SchemaValidator: rejectAll{},
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	require.Equal(t, "rejected", strings.TrimSpace(rec.Body.String()))
+}
+
+func TestJSONSchemaFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "schema.json")
+	require.NoError(t, os.WriteFile(file, []byte(userSchema), 0o600))
+
+	_, err := proxy.NewHandlerWithConfig(proxy.Config{TargetURL: "http://localhost", Timeout: timeout, JSONSchemaFile: file})
+	require.NoError(t, err)
+
+	_, err = proxy.NewHandlerWithConfig(proxy.Config{TargetURL: "http://localhost", Timeout: timeout, JSONSchemaFile: file + ".missing"})
+	require.Error(t, err)
+
+	_, err = proxy.NewHandlerWithConfig(proxy.Config{TargetURL: "http://localhost", Timeout: timeout, JSONSchema: `{"pattern": "("}`})
+	require.Error(t, err)
+}
+
+func TestJSONSchemaUnsupported(t *testing.T) {
+	// checking only part of a schema would let invalid bodies through
+	for _, schema := range []string{
+		`{"oneOf": [{"type": "string"}, {"type": "integer"}]}`,
+		`{"type": "object", "properties": {"owner": {"$ref": "#/$defs/user"}}}`,
+		`{"type": "array", "items": {"type": "string", "format": "email"}}`,
+	} {
+		_, err := proxy.NewJSONSchemaValidator([]byte(schema))
+		require.ErrorContains(t, err, "unsupported keyword", schema)
+	}
+
+	// annotations check nothing, they are accepted
+	_, err := proxy.NewJSONSchemaValidator([]byte(`{"$schema": "https://json-schema.org/draft/2020-12/schema", "title": "User", "description": "A user", "type": "object"}`))
+	require.NoError(t, err)
+}
+
+func TestJSONSchemaConstNull(t *testing.T) {
+	v, err := proxy.NewJSONSchemaValidator([]byte(`{"properties": {"deleted": {"const": null}}}`))
+	require.NoError(t, err)
+
+	// a const of null is one, only null matches it
+	require.NoError(t, v.ValidateJSON([]byte(`{"deleted": null}`)))
+	require.Error(t, v.ValidateJSON([]byte(`{"deleted": true}`)))
+	require.NoError(t, v.ValidateJSON([]byte(`{}`)))
+}
+
+func TestJSONSchemaLargeBody(t *testing.T) {
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer target.Close()
+
+	// without MaxRequestBodyBytes, the body read for validation is still limited
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{TargetURL: target.URL, Timeout: timeout, JSONSchema: `{"type": "array"}`})
+	require.NoError(t, err)
+
+	body := "[" + strings.Repeat(`"0123456789",`, 100000) + `""]`
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	require.Zero(t, atomic.LoadInt32(&hits))
+}
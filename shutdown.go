@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// ErrShuttingDown is returned with 503 for requests arriving after Shutdown
+var ErrShuttingDown = errors.New("proxy: shutting down")
+
+// Proxy is an http.Handler proxying requests like the handler created by
+// NewHandlerWithConfig, which can be shut down gracefully
+type Proxy struct {
+	handler      http.HandlerFunc
+	cfg          Config
+	counters     *counters
+	ch           chan<- Data
+	unreadyAfter int
+
+	mu       sync.RWMutex
+	stopping bool
+	inFlight sync.WaitGroup
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// NewProxy creates Proxy from the given config
+func NewProxy(cfg Config) (*Proxy, error) {
+	c := &counters{}
+	h, err := newConfiguredHandler(cfg, c)
+	if err != nil {
+		return nil, err
+	}
+
+	unreadyAfter := cfg.UnreadyAfter
+	if unreadyAfter == 0 {
+		unreadyAfter = defaultUnreadyAfter
+	}
+
+	return &Proxy{handler: h, cfg: cfg, counters: c, ch: cfg.DataChan, unreadyAfter: unreadyAfter, closed: make(chan struct{})}, nil
+}
+
+// ServeHTTP proxies the request, unless the proxy is shutting down
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	if p.stopping {
+		p.mu.RUnlock()
+		http.Error(w, ErrShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	p.inFlight.Add(1)
+	p.mu.RUnlock()
+
+	defer p.inFlight.Done()
+	p.handler(w, r)
+}
+
+// Shutdown stops accepting new requests and waits for the in-flight ones to
+// finish, then closes the Data channel so that consumers ranging over it
+// terminate. When ctx is done first, its error is returned and the channel
+// is closed once the remaining requests finish. Shutdown may be called more
+// than once, the channel is only closed once
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.stopping = true
+	p.mu.Unlock()
+
+	p.once.Do(func() {
+		go func() {
+			p.inFlight.Wait()
+			if p.ch != nil {
+				close(p.ch)
+			}
+			close(p.closed)
+		}()
+	})
+
+	select {
+	case <-p.closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
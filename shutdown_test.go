@@ -0,0 +1,114 @@
+package proxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdown(t *testing.T) {
+	const requests = 5
+	mchan := make(chan proxy.Data, requests)
+
+	started := make(chan struct{}, requests)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		time.Sleep(200 * time.Millisecond)
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	p, err := proxy.NewProxy(proxy.Config{
+		TargetURL: target.URL,
+		Timeout:   timeout,
+		DataChan:  mchan,
+	})
+	require.NoError(t, err)
+
+	prx := httptest.NewServer(p)
+	defer prx.Close()
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := prx.Client().Get(prx.URL)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			res.Body.Close()
+			statuses <- res.StatusCode
+		}()
+	}
+	for i := 0; i < requests; i++ {
+		<-started
+	}
+
+	require.NoError(t, p.Shutdown(context.Background()))
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		require.Equal(t, http.StatusOK, status)
+	}
+
+	var published int
+	for range mchan {
+		published++
+	}
+	require.Equal(t, requests, published)
+
+	// the channel is closed already, a second call must not close it again
+	require.NoError(t, p.Shutdown(context.Background()))
+
+	res, err := prx.Client().Get(prx.URL)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	mchan := make(chan proxy.Data, 1)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer target.Close()
+
+	p, err := proxy.NewProxy(proxy.Config{
+		TargetURL: target.URL,
+		Timeout:   timeout,
+		DataChan:  mchan,
+	})
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, p.Shutdown(ctx), context.DeadlineExceeded)
+
+	// the channel is closed once the remaining request finishes
+	close(release)
+	<-done
+	_, ok := <-mchan
+	require.True(t, ok)
+	_, ok = <-mchan
+	require.False(t, ok)
+}
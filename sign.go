@@ -0,0 +1,20 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+)
+
+// sign computes the signature of req sent upstream with body, see
+// Config.SigningSecret
+func sign(cfg *Config, req *http.Request, body []byte) string {
+	mac := hmac.New(sha256.New, cfg.SigningSecret)
+	if cfg.SignMethodAndPath {
+		io.WriteString(mac, req.Method+"\n"+req.URL.RequestURI()+"\n")
+	}
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
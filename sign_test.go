@@ -0,0 +1,58 @@
+package proxy_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestSigning(t *testing.T) {
+	secret := []byte("shared secret")
+
+	for name, withPath := range map[string]bool{"body": false, "method and path": true} {
+		t.Run(name, func(t *testing.T) {
+			var body []byte
+			var signature string
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var err error
+				body, err = io.ReadAll(r.Body)
+				require.NoError(t, err)
+				require.Equal(t, int64(len(body)), r.ContentLength)
+				signature = r.Header.Get("X-Body-Signature")
+			}))
+			defer target.Close()
+
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL:         target.URL,
+				Timeout:           timeout,
+				SigningSecret:     secret,
+				SignatureHeader:   "X-Body-Signature",
+				SignMethodAndPath: withPath,
+				RequestBodyTransform: func(body io.Reader) (io.Reader, error) {
+					b, err := io.ReadAll(body)
+					return strings.NewReader(strings.ToUpper(string(b))), err
+				},
+			})
+			require.NoError(t, err)
+
+			res := doRequest(t, h, http.MethodPost, requestHeaders)
+			require.Equal(t, http.StatusOK, res.StatusCode)
+			require.Equal(t, strings.ToUpper(requestBody), string(body), "the transformed body must be signed")
+
+			mac := hmac.New(sha256.New, secret)
+			if withPath {
+				mac.Write([]byte("POST\n/some/path\n"))
+			}
+			mac.Write(body)
+			require.Equal(t, hex.EncodeToString(mac.Sum(nil)), signature)
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"container/list"
+	"io"
+	"sync"
+)
+
+// CaptureSink receives captured bodies as they're proxied, instead of Data,
+// see Config.CaptureSink. Each method gets the ID of the request, as in
+// Data.RequestID, and a reader streaming the body, which ends with it. The
+// methods run in goroutines of their own and may still be reading when Data
+// is published. A slow sink never holds up the proxied bodies: the bytes it
+// falls more than 1 MiB behind on are dropped, and the capture is marked
+// truncated
+type CaptureSink interface {
+	WriteRequest(id string, r io.Reader)
+	WriteResponse(id string, r io.Reader)
+}
+
+// most bytes buffered for a sink that didn't read them yet
+const sinkBufferBytes = 1 << 20
+
+// sinkCapture streams a body to a CaptureSink as it's proxied. Like
+// captureBuffer, it keeps at most limit bytes and never fails the stream
+// it's teed from. Nor does it block it: the sink reads from a buffer, and
+// once it's full, the rest of the body is dropped
+type sinkCapture struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	// closed is set once the body ended, abandoned once the sink returned
+	closed    bool
+	abandoned bool
+	limit     int64
+	size      int64
+	truncated bool
+}
+
+func newSinkCapture(write func(id string, r io.Reader), id string, limit int64) *sinkCapture {
+	c := &sinkCapture{limit: limit}
+	c.cond = sync.NewCond(&c.mu)
+	go func() {
+		write(id, sinkReader{c})
+		// the rest of a body the sink didn't read is discarded
+		c.mu.Lock()
+		c.abandoned = true
+		c.buf = nil
+		c.mu.Unlock()
+	}()
+	return c
+}
+
+func (c *sinkCapture) Write(p []byte) (int, error) {
+	n := len(p)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// a capture with a gap would be worse than a truncated one
+	if c.truncated || c.abandoned || c.closed {
+		return n, nil
+	}
+	if c.limit > 0 {
+		if room := c.limit - c.size; int64(len(p)) > room {
+			p = p[:room]
+			c.truncated = true
+		}
+	}
+	if room := sinkBufferBytes - len(c.buf); len(p) > room {
+		p = p[:room]
+		c.truncated = true
+	}
+	c.size += int64(len(p))
+	if len(p) > 0 {
+		c.buf = append(c.buf, p...)
+		c.cond.Signal()
+	}
+	return n, nil
+}
+
+// close ends the body streamed to the sink, without waiting for the sink to
+// read it, and reports whether the capture was truncated
+func (c *sinkCapture) close() (truncated bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	c.cond.Signal()
+	return c.truncated
+}
+
+// sinkReader is the reader a CaptureSink gets the body from
+type sinkReader struct {
+	c *sinkCapture
+}
+
+func (r sinkReader) Read(p []byte) (int, error) {
+	c := r.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.buf) == 0 && !c.closed {
+		c.cond.Wait()
+	}
+	if len(c.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// most requests MemorySink keeps the bodies of when MaxRequests is zero
+const defaultMemorySinkRequests = 1000
+
+// MemorySink is a CaptureSink keeping the captured bodies in memory until
+// they're taken, like the capture into Data does until it's consumed. The
+// bodies of at most MaxRequests requests are kept, those nobody took are
+// forgotten oldest first. As sinks may still be reading once Data is
+// published, the bodies of a request may be taken a moment after it
+type MemorySink struct {
+	// MaxRequests is the most requests the bodies are kept of, 1000 when zero
+	MaxRequests int
+
+	mu       sync.Mutex
+	captures map[string]*list.Element
+	// oldest first
+	order *list.List
+}
+
+// memoryCapture holds the bodies of a request in MemorySink
+type memoryCapture struct {
+	id                string
+	request, response []byte
+}
+
+// WriteRequest stores the request body of the request with the given ID
+func (s *MemorySink) WriteRequest(id string, r io.Reader) {
+	body, _ := io.ReadAll(r)
+	s.store(id, func(c *memoryCapture) { c.request = body })
+}
+
+// WriteResponse stores the response body of the request with the given ID
+func (s *MemorySink) WriteResponse(id string, r io.Reader) {
+	body, _ := io.ReadAll(r)
+	s.store(id, func(c *memoryCapture) { c.response = body })
+}
+
+func (s *MemorySink) store(id string, set func(*memoryCapture)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.captures == nil {
+		s.captures = make(map[string]*list.Element)
+		s.order = list.New()
+	}
+	el, ok := s.captures[id]
+	if !ok {
+		el = s.order.PushBack(&memoryCapture{id: id})
+		s.captures[id] = el
+	}
+	set(el.Value.(*memoryCapture))
+
+	max := s.MaxRequests
+	if max <= 0 {
+		max = defaultMemorySinkRequests
+	}
+	for s.order.Len() > max {
+		oldest := s.order.Front()
+		s.order.Remove(oldest)
+		delete(s.captures, oldest.Value.(*memoryCapture).id)
+	}
+}
+
+// Take returns the bodies captured for the request with the given ID, nil
+// for those not captured, and forgets them
+func (s *MemorySink) Take(id string) (request, response []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.captures[id]
+	if !ok {
+		return nil, nil
+	}
+	s.order.Remove(el)
+	delete(s.captures, id)
+	c := el.Value.(*memoryCapture)
+	return c.request, c.response
+}
@@ -0,0 +1,211 @@
+package proxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// mapSink records captured bodies by request ID
+type mapSink struct {
+	mu     sync.Mutex
+	bodies map[string]string
+}
+
+func (s *mapSink) WriteRequest(id string, r io.Reader)  { s.record("request "+id, r) }
+func (s *mapSink) WriteResponse(id string, r io.Reader) { s.record("response "+id, r) }
+
+func (s *mapSink) record(key string, r io.Reader) {
+	body, _ := io.ReadAll(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bodies[key] = string(body)
+}
+
+func TestCaptureSink(t *testing.T) {
+	largeBody := strings.Repeat("0123456789", 10000)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validateBody(t, r.Body, requestBody)
+		writeResponse(w, largeBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	for name, limit := range map[string]int64{"whole bodies": 0, "limited": 5} {
+		t.Run(name, func(t *testing.T) {
+			mchan := make(chan proxy.Data, 1)
+			sink := &mapSink{bodies: map[string]string{}}
+			h, err := proxy.NewHandlerWithConfig(proxy.Config{
+				TargetURL:       target.URL,
+				Timeout:         timeout,
+				DataChan:        mchan,
+				CaptureRequest:  true,
+				CaptureResponse: true,
+				MaxCaptureBytes: limit,
+				CaptureSink:     sink,
+			})
+			require.NoError(t, err)
+
+			res := doRequest(t, h, http.MethodPost, requestHeaders)
+			require.Equal(t, http.StatusOK, res.StatusCode)
+			validateBody(t, res.Body, largeBody)
+
+			// Data only refers to the captures, which the sink may still be reading
+			data := <-mchan
+			require.Nil(t, data.Request)
+			require.Nil(t, data.Response)
+			require.Equal(t, limit > 0, data.RequestCaptureTruncated)
+			require.Equal(t, limit > 0, data.ResponseCaptureTruncated)
+
+			expectedRequest, expectedResponse := requestBody, largeBody
+			if limit > 0 {
+				expectedRequest, expectedResponse = requestBody[:limit], largeBody[:limit]
+			}
+			require.Eventually(t, func() bool {
+				sink.mu.Lock()
+				defer sink.mu.Unlock()
+				return len(sink.bodies) == 2
+			}, timeout, time.Millisecond)
+			sink.mu.Lock()
+			defer sink.mu.Unlock()
+			require.Equal(t, map[string]string{
+				"request " + data.RequestID:  expectedRequest,
+				"response " + data.RequestID: expectedResponse,
+			}, sink.bodies)
+		})
+	}
+}
+
+// stingySink only reads the first bytes of the bodies
+type stingySink struct{}
+
+func (stingySink) WriteRequest(id string, r io.Reader)  { r.Read(make([]byte, 1)) }
+func (stingySink) WriteResponse(id string, r io.Reader) { r.Read(make([]byte, 1)) }
+
+func TestCaptureSinkNotReading(t *testing.T) {
+	largeBody := strings.Repeat("0123456789", 10000)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validateBody(t, r.Body, requestBody)
+		writeResponse(w, largeBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	// a sink giving up on a body must not stall it
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:       target.URL,
+		Timeout:         timeout,
+		CaptureRequest:  true,
+		CaptureResponse: true,
+		CaptureSink:     stingySink{},
+	})
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodPost, requestHeaders)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	validateBody(t, res.Body, largeBody)
+}
+
+func TestMemorySink(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	mchan := make(chan proxy.Data, 1)
+	sink := &proxy.MemorySink{}
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:       target.URL,
+		Timeout:         timeout,
+		DataChan:        mchan,
+		CaptureRequest:  true,
+		CaptureResponse: true,
+		CaptureSink:     sink,
+	})
+	require.NoError(t, err)
+
+	doRequest(t, h, http.MethodPost, requestHeaders)
+	data := <-mchan
+
+	var request, response []byte
+	require.Eventually(t, func() bool {
+		req, res := sink.Take(data.RequestID)
+		if req != nil {
+			request = req
+		}
+		if res != nil {
+			response = res
+		}
+		return request != nil && response != nil
+	}, timeout, time.Millisecond)
+	require.Equal(t, requestBody, string(request))
+	require.Equal(t, responseBody, string(response))
+
+	request, response = sink.Take(data.RequestID)
+	require.Nil(t, request, "taken captures are forgotten")
+	require.Nil(t, response)
+}
+
+func TestMemorySinkEviction(t *testing.T) {
+	sink := &proxy.MemorySink{MaxRequests: 2}
+	for _, id := range []string{"1", "2", "3"} {
+		sink.WriteRequest(id, strings.NewReader("request "+id))
+		sink.WriteResponse(id, strings.NewReader("response "+id))
+	}
+
+	request, response := sink.Take("1")
+	require.Nil(t, request, "the oldest captures are forgotten")
+	require.Nil(t, response)
+	for _, id := range []string{"2", "3"} {
+		request, response = sink.Take(id)
+		require.Equal(t, "request "+id, string(request))
+		require.Equal(t, "response "+id, string(response))
+	}
+}
+
+// hungSink never reads the bodies until released
+type hungSink struct {
+	release chan struct{}
+}
+
+func (s hungSink) WriteRequest(id string, r io.Reader)  { <-s.release }
+func (s hungSink) WriteResponse(id string, r io.Reader) { <-s.release }
+
+func TestCaptureSinkHung(t *testing.T) {
+	largeBody := strings.Repeat("0123456789", 200000)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validateBody(t, r.Body, largeBody)
+		writeResponse(w, largeBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	// a sink that stopped reading must neither stall the bodies nor keep
+	// more than a bounded part of them
+	sink := hungSink{release: make(chan struct{})}
+	defer close(sink.release)
+	mchan := make(chan proxy.Data, 1)
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:       target.URL,
+		Timeout:         timeout,
+		DataChan:        mchan,
+		CaptureRequest:  true,
+		CaptureResponse: true,
+		CaptureSink:     sink,
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(largeBody))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, largeBody, w.Body.String())
+
+	data := <-mchan
+	require.True(t, data.RequestCaptureTruncated)
+	require.True(t, data.ResponseCaptureTruncated)
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// spilled captures not read nor closed are removed after this long
+const defaultCaptureSpillTTL = time.Minute
+
+// spillToFile moves the captured bytes into a temporary file, which receives
+// the following writes. The capture stays in memory when the file can't be
+// created
+func (b *captureBuffer) spillToFile() {
+	b.spill = 0
+	file, err := os.CreateTemp("", "proxy-capture-")
+	if err != nil {
+		return
+	}
+	if _, err := file.Write(b.Bytes()); err != nil {
+		removeFile(file)
+		return
+	}
+	b.Reset()
+	b.file = file
+}
+
+// reader returns the capture for Data, reading from the temporary file when
+// it was spilled. The file is removed after ttl at the latest
+func (b *captureBuffer) reader(ttl time.Duration) io.Reader {
+	if b.file == nil {
+		return b
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		removeFile(b.file)
+		return bytes.NewReader(nil)
+	}
+	s := &spilledCapture{file: b.file}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timer = time.AfterFunc(ttl, func() { s.Close() })
+	return s
+}
+
+// contents returns all the captured bytes, removing the temporary file when
+// it was spilled
+func (b *captureBuffer) contents() []byte {
+	if b.file == nil {
+		return b.Bytes()
+	}
+	defer removeFile(b.file)
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return nil
+	}
+	data, _ := io.ReadAll(b.file)
+	return data
+}
+
+// spilledCapture reads a capture from its temporary file, and removes the
+// file once it's read to the end, closed, or its deadline passed
+type spilledCapture struct {
+	mu    sync.Mutex
+	file  *os.File
+	timer *time.Timer
+	// err is returned by reads once the file is removed
+	err error
+}
+
+func (s *spilledCapture) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	n, err := s.file.Read(p)
+	if err == io.EOF {
+		s.close(io.EOF)
+	}
+	return n, err
+}
+
+// Close removes the temporary file. It's safe to call more than once
+func (s *spilledCapture) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.close(os.ErrClosed)
+}
+
+func (s *spilledCapture) close(err error) error {
+	if s.err != nil {
+		return nil
+	}
+	s.err = err
+	s.timer.Stop()
+	return removeFile(s.file)
+}
+
+func removeFile(file *os.File) error {
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// Close releases the resources held by the captured bodies, like the
+// temporary files of captures beyond Config.CaptureSpillBytes. Consumers
+// not reading Request and Response to the end should call it once done
+func (d Data) Close() error {
+	var err error
+	for _, r := range []io.Reader{d.Request, d.Response} {
+		if c, ok := r.(io.Closer); ok {
+			if cerr := c.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
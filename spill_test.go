@@ -0,0 +1,98 @@
+package proxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureSpillBytes(t *testing.T) {
+	largeBody := strings.Repeat("0123456789", 100000)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validateBody(t, r.Body, largeBody)
+		writeResponse(w, largeBody, responseHeaders)
+	}))
+	defer target.Close()
+
+	newProxy := func(ttl time.Duration) (*httptest.Server, chan proxy.Data) {
+		mchan := make(chan proxy.Data, 1)
+		h, err := proxy.NewHandlerWithConfig(proxy.Config{
+			TargetURL:         target.URL,
+			Timeout:           timeout,
+			DataChan:          mchan,
+			CaptureRequest:    true,
+			CaptureResponse:   true,
+			CaptureSpillBytes: 1024,
+			CaptureSpillTTL:   ttl,
+		})
+		require.NoError(t, err)
+		return httptest.NewServer(h), mchan
+	}
+	post := func(url string) {
+		res, err := http.Post(url, "text/plain", strings.NewReader(largeBody))
+		require.NoError(t, err)
+		validateBody(t, res.Body, largeBody)
+	}
+	spilled := func(tmp string) int {
+		entries, err := os.ReadDir(tmp)
+		require.NoError(t, err)
+		return len(entries)
+	}
+
+	t.Run("read", func(t *testing.T) {
+		tmp := t.TempDir()
+		t.Setenv("TMPDIR", tmp)
+		prx, mchan := newProxy(0)
+		defer prx.Close()
+
+		post(prx.URL)
+		data := <-mchan
+		require.Equal(t, 2, spilled(tmp), "both captures must be on disk")
+
+		captured, err := io.ReadAll(data.Request)
+		require.NoError(t, err)
+		require.Equal(t, largeBody, string(captured))
+		captured, err = io.ReadAll(data.Response)
+		require.NoError(t, err)
+		require.Equal(t, largeBody, string(captured))
+		require.False(t, data.RequestCaptureTruncated)
+		require.False(t, data.ResponseCaptureTruncated)
+
+		require.Zero(t, spilled(tmp), "captures read to the end must be removed")
+		require.NoError(t, data.Close())
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		tmp := t.TempDir()
+		t.Setenv("TMPDIR", tmp)
+		prx, mchan := newProxy(0)
+		defer prx.Close()
+
+		post(prx.URL)
+		data := <-mchan
+		require.NoError(t, data.Close())
+		require.Zero(t, spilled(tmp))
+
+		_, err := data.Request.Read(make([]byte, 1))
+		require.ErrorIs(t, err, os.ErrClosed)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		tmp := t.TempDir()
+		t.Setenv("TMPDIR", tmp)
+		prx, mchan := newProxy(50 * time.Millisecond)
+		defer prx.Close()
+
+		post(prx.URL)
+		<-mchan
+		require.Eventually(t, func() bool { return spilled(tmp) == 0 }, timeout, 10*time.Millisecond)
+	})
+}
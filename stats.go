@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the request counters of a Proxy
+type Stats struct {
+	// InFlight is the number of requests being proxied
+	InFlight int64
+	// Total is the number of requests handled so far
+	Total uint64
+	// Dropped is the number of Data items not published because the Data
+	// channel was full
+	Dropped uint64
+	// Statuses counts the requests handled so far by the status code the
+	// clients got
+	Statuses map[int]uint64
+}
+
+// counters of requests going through a handler, kept atomically, and the
+// readiness they tell
+type counters struct {
+	inFlight int64
+	total    uint64
+	dropped  uint64
+
+	mu       sync.Mutex
+	statuses map[int]uint64
+
+	ready readiness
+	// upstreams of the handler, set by it
+	upstreams []*upstream
+}
+
+// status counts a request answered with the given status code
+func (c *counters) status(code int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.statuses == nil {
+		c.statuses = make(map[int]uint64)
+	}
+	c.statuses[code]++
+}
+
+// done counts a finished request
+func (c *counters) done() {
+	atomic.AddUint64(&c.total, 1)
+	atomic.AddInt64(&c.inFlight, -1)
+}
+
+// InFlight returns the number of requests being proxied
+func (p *Proxy) InFlight() int64 {
+	return atomic.LoadInt64(&p.counters.inFlight)
+}
+
+// Total returns the number of requests handled so far
+func (p *Proxy) Total() uint64 {
+	return atomic.LoadUint64(&p.counters.total)
+}
+
+// Stats returns a snapshot of the request counters. Unlike the package level
+// Dropped, the count of dropped Data items only covers this proxy
+func (p *Proxy) Stats() Stats {
+	c := p.counters
+	c.mu.Lock()
+	statuses := make(map[int]uint64, len(c.statuses))
+	for code, n := range c.statuses {
+		statuses[code] = n
+	}
+	c.mu.Unlock()
+
+	return Stats{
+		InFlight: p.InFlight(),
+		Total:    p.Total(),
+		Dropped:  atomic.LoadUint64(&c.dropped),
+		Statuses: statuses,
+	}
+}
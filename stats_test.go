@@ -0,0 +1,78 @@
+package proxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	const requests = 50
+
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer target.Close()
+
+	// the channel only takes one item, the rest is dropped
+	p, err := proxy.NewProxy(proxy.Config{
+		TargetURL: target.URL,
+		Timeout:   timeout,
+		DataChan:  make(chan proxy.Data, 1),
+	})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		return p.InFlight() == requests
+	}, timeout, time.Millisecond)
+	require.Zero(t, p.Total())
+
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, proxy.Stats{
+		InFlight: 0,
+		Total:    requests,
+		Dropped:  requests - 1,
+		Statuses: map[int]uint64{http.StatusOK: requests},
+	}, p.Stats())
+}
+
+func TestNilDataChan(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(responseBody))
+	}))
+	defer target.Close()
+
+	p, err := proxy.NewProxy(proxy.Config{
+		TargetURL:       target.URL,
+		Timeout:         timeout,
+		CaptureResponse: true,
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, responseBody, w.Body.String())
+
+	// nothing is published, so nothing is dropped either
+	require.Equal(t, proxy.Stats{Total: 1, Statuses: map[int]uint64{http.StatusOK: 1}}, p.Stats())
+	require.NoError(t, p.Shutdown(context.Background()))
+}
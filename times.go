@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Times is struct to store request time
+type Times struct {
+	Start                time.Time
+	WroteRequest         time.Time
+	GotFirstResponseByte time.Time
+	End                  time.Time
+
+	// DNSStart and DNSDone surround the lookup of the upstream host, and
+	// ConnectStart and ConnectDone dialing it. They are only set when a new
+	// upstream connection was opened, and the host wasn't an IP address
+	// for the former
+	DNSStart     time.Time
+	DNSDone      time.Time
+	ConnectStart time.Time
+	ConnectDone  time.Time
+}
+
+// TTFB returns the time from the start of the request till the first byte of
+// the upstream response, or zero if no response arrived
+func (t Times) TTFB() time.Duration {
+	return elapsed(t.Start, t.GotFirstResponseByte)
+}
+
+// Total returns the time spent handling the request
+func (t Times) Total() time.Duration {
+	return elapsed(t.Start, t.End)
+}
+
+// UpstreamLatency returns the time the upstream took to respond once the
+// request was written, or zero if either of the events didn't happen
+func (t Times) UpstreamLatency() time.Duration {
+	return elapsed(t.WroteRequest, t.GotFirstResponseByte)
+}
+
+// DNSLookup returns the time the lookup of the upstream host took, or zero
+// if there was none
+func (t Times) DNSLookup() time.Duration {
+	return elapsed(t.DNSStart, t.DNSDone)
+}
+
+// Connect returns the time dialing the upstream took, or zero if a pooled
+// connection was used
+func (t Times) Connect() time.Duration {
+	return elapsed(t.ConnectStart, t.ConnectDone)
+}
+
+// timesJSON is the JSON form of Times, with durations in milliseconds.
+// Durations of events that didn't happen are left out
+type timesJSON struct {
+	TotalMS    float64 `json:"total_ms"`
+	TTFBMS     float64 `json:"ttfb_ms,omitempty"`
+	UpstreamMS float64 `json:"upstream_ms,omitempty"`
+	DNSMS      float64 `json:"dns_ms,omitempty"`
+	ConnectMS  float64 `json:"connect_ms,omitempty"`
+}
+
+// MarshalJSON encodes the durations of t, rather than its timestamps, as an
+// object with total_ms, ttfb_ms, upstream_ms, dns_ms and connect_ms. The
+// ones of events that didn't happen, like the DNS lookup of a pooled
+// connection, are left out
+func (t Times) MarshalJSON() ([]byte, error) {
+	return json.Marshal(timesJSON{
+		TotalMS:    milliseconds(t.Total()),
+		TTFBMS:     milliseconds(t.TTFB()),
+		UpstreamMS: milliseconds(t.UpstreamLatency()),
+		DNSMS:      milliseconds(t.DNSLookup()),
+		ConnectMS:  milliseconds(t.Connect()),
+	})
+}
+
+// String returns a summary of the durations of t, like
+// "total=80ms ttfb=50ms upstream=40ms dns=2ms connect=4ms". The ones of
+// events that didn't happen are left out, apart from total
+func (t Times) String() string {
+	var b strings.Builder
+	b.WriteString("total=" + t.Total().String())
+	for _, part := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"ttfb", t.TTFB()},
+		{"upstream", t.UpstreamLatency()},
+		{"dns", t.DNSLookup()},
+		{"connect", t.Connect()},
+	} {
+		if part.d != 0 {
+			b.WriteString(" " + part.name + "=" + part.d.String())
+		}
+	}
+	return b.String()
+}
+
+// dialTrace records the times of opening an upstream connection. The
+// transport dials in goroutines of its own, which may outlive the request,
+// hence the lock
+type dialTrace struct {
+	mu           sync.Mutex
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+}
+
+// record sets *p, one of the fields of dt, to the current time. With several
+// addresses dialed, only the first start counts, when keep is set
+func (dt *dialTrace) record(p *time.Time, keep bool) {
+	now := time.Now()
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if keep && !p.IsZero() {
+		return
+	}
+	*p = now
+}
+
+// into copies the recorded times into t
+func (dt *dialTrace) into(t *Times) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	t.DNSStart, t.DNSDone = dt.dnsStart, dt.dnsDone
+	t.ConnectStart, t.ConnectDone = dt.connectStart, dt.connectDone
+}
+
+// elapsed returns the time passed from start to t, or zero when either is not set
+func elapsed(start, t time.Time) time.Duration {
+	if start.IsZero() || t.IsZero() {
+		return 0
+	}
+	return t.Sub(start)
+}
+
+// milliseconds returns d as a fractional number of milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,114 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimesDurations(t *testing.T) {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	times := proxy.Times{
+		Start:                start,
+		WroteRequest:         start.Add(10 * time.Millisecond),
+		GotFirstResponseByte: start.Add(50 * time.Millisecond),
+		End:                  start.Add(80 * time.Millisecond),
+		DNSStart:             start.Add(1 * time.Millisecond),
+		DNSDone:              start.Add(3 * time.Millisecond),
+		ConnectStart:         start.Add(3 * time.Millisecond),
+		ConnectDone:          start.Add(7 * time.Millisecond),
+	}
+
+	require.Equal(t, 50*time.Millisecond, times.TTFB())
+	require.Equal(t, 80*time.Millisecond, times.Total())
+	require.Equal(t, 40*time.Millisecond, times.UpstreamLatency())
+	require.Equal(t, 2*time.Millisecond, times.DNSLookup())
+	require.Equal(t, 4*time.Millisecond, times.Connect())
+}
+
+func TestTimesUnset(t *testing.T) {
+	require.Zero(t, proxy.Times{}.TTFB())
+	require.Zero(t, proxy.Times{}.Total())
+	require.Zero(t, proxy.Times{}.UpstreamLatency())
+
+	// upstream failed before responding
+	start := time.Now()
+	times := proxy.Times{Start: start, End: start.Add(time.Second)}
+	require.Zero(t, times.TTFB())
+	require.Zero(t, times.UpstreamLatency())
+	require.Equal(t, time.Second, times.Total())
+}
+
+func TestTimesFormat(t *testing.T) {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	times := proxy.Times{
+		Start:                start,
+		WroteRequest:         start.Add(10 * time.Millisecond),
+		GotFirstResponseByte: start.Add(50 * time.Millisecond),
+		End:                  start.Add(80 * time.Millisecond),
+		DNSStart:             start.Add(1 * time.Millisecond),
+		DNSDone:              start.Add(3 * time.Millisecond),
+		ConnectStart:         start.Add(3 * time.Millisecond),
+		ConnectDone:          start.Add(7500 * time.Microsecond),
+	}
+	// a pooled connection, and a failure before the upstream responded
+	pooled := proxy.Times{
+		Start:                start,
+		WroteRequest:         start.Add(10 * time.Millisecond),
+		GotFirstResponseByte: start.Add(50 * time.Millisecond),
+		End:                  start.Add(80 * time.Millisecond),
+	}
+	failed := proxy.Times{Start: start, End: start.Add(time.Second)}
+
+	cases := map[string]struct {
+		times     proxy.Times
+		str, json string
+	}{
+		"complete": {times, "total=80ms ttfb=50ms upstream=40ms dns=2ms connect=4.5ms",
+			`{"total_ms":80,"ttfb_ms":50,"upstream_ms":40,"dns_ms":2,"connect_ms":4.5}`},
+		"pooled": {pooled, "total=80ms ttfb=50ms upstream=40ms", `{"total_ms":80,"ttfb_ms":50,"upstream_ms":40}`},
+		"failed": {failed, "total=1s", `{"total_ms":1000}`},
+		"unset":  {proxy.Times{}, "total=0s", `{"total_ms":0}`},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, c.str, c.times.String())
+			b, err := json.Marshal(c.times)
+			require.NoError(t, err)
+			require.JSONEq(t, c.json, string(b))
+		})
+	}
+}
+
+func TestDialTimes(t *testing.T) {
+	mchan := make(chan proxy.Data, 2)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	// a host name, rather than the IP address of the server, is looked up
+	_, port, err := net.SplitHostPort(target.Listener.Addr().String())
+	require.NoError(t, err)
+	h, err := proxy.NewHandler("http://localhost:"+port, timeout, mchan, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	fresh := <-mchan
+	require.False(t, fresh.Times.DNSStart.IsZero())
+	require.False(t, fresh.Times.DNSDone.IsZero())
+	require.Greater(t, fresh.Times.Connect(), time.Duration(0))
+
+	// a pooled connection needs neither
+	pooled := <-mchan
+	require.Zero(t, pooled.Times.DNSLookup())
+	require.Zero(t, pooled.Times.Connect())
+}
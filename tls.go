@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// headers passing details of the client TLS connection to the upstream
+const (
+	clientCertSubjectHeader = "X-Client-Cert-Subject"
+	clientCertSerialHeader  = "X-Client-Cert-Serial"
+	clientSNIHeader         = "X-Client-SNI"
+)
+
+// loadTLS merges the client certificate, CA bundle and InsecureSkipVerify
+// settings into a copy of c.TLSConfig
+func (c *Config) loadTLS() error {
+	if c.ClientCertFile == "" && c.ClientKeyFile == "" && c.CAFile == "" && !c.InsecureSkipVerify {
+		return nil
+	}
+
+	tc := c.TLSConfig.Clone()
+	if tc == nil {
+		tc = &tls.Config{}
+	}
+
+	if c.ClientCertFile != "" || c.ClientKeyFile != "" {
+		if c.ClientCertFile == "" || c.ClientKeyFile == "" {
+			return errors.New("proxy: client certificate and key files must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+		if err != nil {
+			return fmt.Errorf("proxy: loading client certificate: %v", err)
+		}
+		tc.Certificates = append(tc.Certificates, cert)
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return fmt.Errorf("proxy: reading CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("proxy: no certificates found in CA bundle %s", c.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	tc.InsecureSkipVerify = tc.InsecureSkipVerify || c.InsecureSkipVerify
+	c.TLSConfig = tc
+
+	return nil
+}
+
+// setClientCertHeaders sets the client TLS headers from the connection of r,
+// replacing those the client may have sent to spoof them. The certificate
+// ones are only set when the client certificate was verified
+func setClientCertHeaders(h http.Header, r *http.Request) {
+	h.Del(clientCertSubjectHeader)
+	h.Del(clientCertSerialHeader)
+	h.Del(clientSNIHeader)
+	if r.TLS == nil {
+		return
+	}
+
+	if r.TLS.ServerName != "" {
+		h.Set(clientSNIHeader, r.TLS.ServerName)
+	}
+	if len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		h.Set(clientCertSubjectHeader, cert.Subject.String())
+		h.Set(clientCertSerialHeader, cert.SerialNumber.Text(16))
+	}
+}
@@ -0,0 +1,200 @@
+package proxy_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// write PEM block to a file in dir, returning its path
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+	return path
+}
+
+// generate a self-signed CA and a client certificate issued by it, returning
+// the CA pool and paths to the client certificate and key files
+func generateClientCert(t *testing.T, dir string) (*x509.CertPool, string, string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	return pool, writePEM(t, dir, "client.crt", "CERTIFICATE", der), writePEM(t, dir, "client.key", "EC PRIVATE KEY", keyDER)
+}
+
+func TestMutualTLSUpstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxy-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clientCAs, certFile, keyFile := generateClientCert(t, dir)
+
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, responseBody, responseHeaders)
+	}))
+	target.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	target.StartTLS()
+	defer target.Close()
+
+	caFile := writePEM(t, dir, "ca.crt", "CERTIFICATE", target.Certificate().Raw)
+
+	cases := map[string]struct {
+		cfg    proxy.Config
+		status int
+	}{
+		"with client certificate": {
+			proxy.Config{CAFile: caFile, ClientCertFile: certFile, ClientKeyFile: keyFile},
+			http.StatusOK,
+		},
+		"without client certificate": {
+			proxy.Config{CAFile: caFile},
+			http.StatusBadGateway,
+		},
+		"untrusted upstream": {
+			proxy.Config{ClientCertFile: certFile, ClientKeyFile: keyFile},
+			http.StatusBadGateway,
+		},
+		"skipping verification": {
+			proxy.Config{ClientCertFile: certFile, ClientKeyFile: keyFile, InsecureSkipVerify: true},
+			http.StatusOK,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := c.cfg
+			cfg.TargetURL = target.URL
+			cfg.Timeout = timeout
+
+			h, err := proxy.NewHandlerWithConfig(cfg)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			require.Equal(t, c.status, w.Code)
+		})
+	}
+}
+
+func TestInvalidTLSFiles(t *testing.T) {
+	for name, cfg := range map[string]proxy.Config{
+		"missing key":    {ClientCertFile: "client.crt"},
+		"missing files":  {ClientCertFile: "missing.crt", ClientKeyFile: "missing.key"},
+		"missing bundle": {CAFile: "missing.pem"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg.TargetURL = "https://localhost"
+			cfg.Timeout = timeout
+
+			_, err := proxy.NewHandlerWithConfig(cfg)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestForwardClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxy-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clientCAs, certFile, keyFile := generateClientCert(t, dir)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+
+	headers := make(chan http.Header, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:         target.URL,
+		Timeout:           timeout,
+		ForwardClientCert: true,
+	})
+	require.NoError(t, err)
+
+	prx := httptest.NewUnstartedServer(h)
+	prx.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: clientCAs}
+	prx.StartTLS()
+	defer prx.Close()
+
+	cases := map[string]struct {
+		certs   []tls.Certificate
+		subject string
+		serial  string
+	}{
+		"with client certificate":    {[]tls.Certificate{cert}, "CN=test client", "2"},
+		"without client certificate": {nil, "", ""},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			client := prx.Client()
+			transport := client.Transport.(*http.Transport).Clone()
+			transport.TLSClientConfig.Certificates = c.certs
+			client.Transport = transport
+
+			req, err := http.NewRequest(http.MethodGet, prx.URL, nil)
+			require.NoError(t, err)
+			// spoofed values must not reach the upstream
+			req.Header.Set("X-Client-Cert-Subject", "CN=admin")
+			req.Header.Set("X-Client-Cert-Serial", "1")
+
+			res, err := client.Do(req)
+			require.NoError(t, err)
+			res.Body.Close()
+			require.Equal(t, http.StatusOK, res.StatusCode)
+
+			h := <-headers
+			require.Equal(t, c.subject, h.Get("X-Client-Cert-Subject"))
+			require.Equal(t, c.serial, h.Get("X-Client-Cert-Serial"))
+		})
+	}
+}
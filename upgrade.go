@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// upgradeType returns the protocol requested via the Upgrade header, when the
+// Connection header asks for an upgrade, or an empty string otherwise
+func upgradeType(h http.Header) string {
+	for _, v := range h["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// processUpgrade passes a protocol upgrade (e.g. WebSocket) through to the
+// upstream. Once the upstream switches protocols, the client connection is
+// hijacked and bytes are spliced in both directions until either side closes.
+// Bodies of upgraded connections are not captured
+func processUpgrade(transport http.RoundTripper, d *Data, req *http.Request, w http.ResponseWriter, upgrade string, cfg *Config) error {
+	// hop-by-hop headers were stripped off, but the upstream must see the upgrade request
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", upgrade)
+
+	res, err := roundTrip(transport, d, req, cfg)
+	if err != nil {
+		d.StatusCode = failureStatus(req, err)
+		return err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return forwardResponse(d, res, w, cfg)
+	}
+
+	d.StatusCode = res.StatusCode
+	d.ResponseHeader = res.Header.Clone()
+
+	backConn, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		res.Body.Close()
+		d.StatusCode = http.StatusBadGateway
+		return errors.New("proxy: upstream switched protocols with a non-writable body")
+	}
+	defer backConn.Close()
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		d.StatusCode = http.StatusInternalServerError
+		return errors.New("proxy: response writer does not support hijacking")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		d.StatusCode = http.StatusInternalServerError
+		return err
+	}
+	defer conn.Close()
+	d.Upgraded = true
+
+	// only the response head goes out here, the body is the upgraded stream
+	clientHeaders(res.Header, d, cfg)
+	res.Body = nil
+	if err := res.Write(brw); err != nil {
+		return err
+	}
+	if err := brw.Flush(); err != nil {
+		return err
+	}
+
+	// the client reader may hold bytes already sent after the request head
+	done := make(chan struct{}, 2)
+	splice := func(dst io.Writer, src io.Reader) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go splice(backConn, brw.Reader)
+	go splice(conn, backConn)
+
+	// whichever side closes first tears down the other via the deferred Close calls
+	<-done
+	return nil
+}
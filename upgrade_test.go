@@ -0,0 +1,122 @@
+package proxy_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/redstarnv/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// echo upstream accepting WebSocket upgrades and sending back whatever it reads
+func newEchoUpgradeServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		io.WriteString(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nX-Backend: ws-1\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw.Reader)
+	}))
+}
+
+func TestUpgradePassthrough(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	target := newEchoUpgradeServer(t)
+	defer target.Close()
+
+	h, err := proxy.NewHandler(target.URL, timeout, mchan, nil)
+	require.NoError(t, err)
+
+	prx := httptest.NewServer(h)
+	defer prx.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(prx.URL, "http://"))
+	require.NoError(t, err)
+
+	_, err = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	require.Equal(t, "websocket", res.Header.Get("Upgrade"))
+
+	for _, msg := range []string{"hello", "world"} {
+		_, err = io.WriteString(conn, msg)
+		require.NoError(t, err)
+
+		echo := make([]byte, len(msg))
+		_, err = io.ReadFull(br, echo)
+		require.NoError(t, err)
+		require.Equal(t, msg, string(echo))
+	}
+	conn.Close()
+
+	data := <-mchan
+	require.True(t, data.Upgraded)
+	require.Equal(t, http.StatusSwitchingProtocols, data.StatusCode)
+	require.NoError(t, data.Error)
+}
+
+func TestUpgradeResponseHeaders(t *testing.T) {
+	target := newEchoUpgradeServer(t)
+	defer target.Close()
+
+	h, err := proxy.NewHandlerWithConfig(proxy.Config{
+		TargetURL:           target.URL,
+		Timeout:             timeout,
+		DropResponseHeaders: []string{"x-backend"},
+	})
+	require.NoError(t, err)
+
+	prx := httptest.NewServer(h)
+	defer prx.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(prx.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	require.NoError(t, err)
+
+	// the 101 gets the headers of any other response
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	require.Equal(t, "websocket", res.Header.Get("Upgrade"))
+	require.Empty(t, res.Header.Get("X-Backend"))
+	require.NotEmpty(t, res.Header.Get("X-Request-ID"))
+}
+
+func TestUpgradeRejectedByUpstream(t *testing.T) {
+	mchan := make(chan proxy.Data, 10)
+
+	target := newEchoUpgradeServer(t)
+	defer target.Close()
+
+	h, err := proxy.NewHandler(target.URL, timeout, mchan, nil)
+	require.NoError(t, err)
+
+	res := doRequest(t, h, http.MethodGet, map[string]string{
+		"Connection": "Upgrade",
+		"Upgrade":    "h2c",
+	})
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	data := <-mchan
+	require.False(t, data.Upgraded)
+}